@@ -0,0 +1,72 @@
+package iface
+
+//CloseCode 连接关闭原因的类型
+type CloseCode int
+
+const (
+	//CloseNone 连接未关闭
+	CloseNone CloseCode = iota
+	//CloseEOF 客户端在包的边界处正常断开连接
+	CloseEOF
+	//CloseReadError 读取数据出错，如连接被重置、包发送到一半时断开
+	CloseReadError
+	//CloseWriteError 向客户端写入数据出错，如写超时
+	CloseWriteError
+	//CloseProtocolError 客户端违反协议，如包头非法、包体过大、PROXY协议头部非法
+	CloseProtocolError
+	//CloseHandshakeError TLS握手失败
+	CloseHandshakeError
+	//CloseKicked 服务端主动调用Stop关闭连接
+	CloseKicked
+	//CloseIdleTimeout 超过读空闲超时未收到客户端数据
+	CloseIdleTimeout
+	//CloseSendQueueFull 发送队列已满，按OverflowDisconnect策略关闭慢消费者
+	CloseSendQueueFull
+	//CloseRejected 超过连接限制被拒绝，如PROXY协议头部中的客户端IP超过max_conn_per_ip
+	CloseRejected
+	//CloseServerShutdown 服务停止
+	CloseServerShutdown
+)
+
+//String 关闭原因的名称
+func (c CloseCode) String() string {
+	switch c {
+	case CloseNone:
+		return "none"
+	case CloseEOF:
+		return "eof"
+	case CloseReadError:
+		return "read_error"
+	case CloseWriteError:
+		return "write_error"
+	case CloseProtocolError:
+		return "protocol_error"
+	case CloseHandshakeError:
+		return "handshake_error"
+	case CloseKicked:
+		return "kicked"
+	case CloseIdleTimeout:
+		return "idle_timeout"
+	case CloseSendQueueFull:
+		return "send_queue_full"
+	case CloseRejected:
+		return "rejected"
+	case CloseServerShutdown:
+		return "server_shutdown"
+	}
+	return "unknown"
+}
+
+//CloseReason 连接关闭的原因
+type CloseReason struct {
+	Code CloseCode //关闭原因的类型
+	Err  error     //导致关闭的底层错误，客户端正常断开及服务端主动关闭时为nil
+}
+
+//String 关闭原因的描述，如"protocol_error: bad packet header"
+func (r CloseReason) String() string {
+	if r.Err == nil {
+		return r.Code.String()
+	}
+	return r.Code.String() + ": " + r.Err.Error()
+}
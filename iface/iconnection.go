@@ -1,6 +1,12 @@
 package iface
 
-import "net"
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/ajdwfnhaps/easy-tcp-server/dto"
+)
 
 //IConnection 定义连接接口
 type IConnection interface {
@@ -9,17 +15,35 @@ type IConnection interface {
 	//停止连接，结束当前连接状态M
 	Stop()
 
-	//从当前连接获取原始的socket TCPConn
-	GetTCPConnection() *net.TCPConn
+	//获取当前连接底层的原始连接，如*net.TCPConn、*net.UnixConn，可断言为ITCPConn调整TCP参数
+	GetConnection() net.Conn
 	//获取当前连接ID
 	GetConnID() uint32
-	//获取远程客户端地址信息
+	//获取远程客户端地址信息，经过PROXY协议代理时为真实的客户端地址
 	RemoteAddr() net.Addr
+	//获取PROXY协议代理的地址，未经过代理时返回nil
+	GetProxyAddr() net.Addr
+	//获取接入当前连接的监听器，通过ServeConn接入的连接返回nil
+	GetListener() IListener
+	//获取导致连接关闭的错误，连接未关闭或正常关闭时为nil
+	GetCloseErr() error
+	//获取连接关闭的原因，连接未关闭时Code为CloseNone
+	CloseReason() CloseReason
+	//获取最后一次收到客户端数据的时间
+	GetLastActivity() time.Time
+	//获取连接的Context，连接关闭时取消
+	Context() context.Context
 
 	//直接将Message数据发送数据给远程的TCP客户端(无缓冲)
 	SendMsg(data []byte) error
 	//直接将Message数据发送给远程的TCP客户端(有缓冲)
 	SendBuffMsg(data []byte) error
+	//将Message数据发送给远程的TCP客户端(有缓冲)，缓冲已满时按policy处理
+	SendBuffMsgWithPolicy(data []byte, policy SendPolicy) error
+	//获取因发送队列已满被丢弃的消息数量
+	GetDroppedCount() uint64
+	//向客户端发送请求并等待相同seqno的响应
+	Call(ctx context.Context, cmd string, data interface{}) (dto.Result, error)
 
 	//设置链接属性
 	SetProperty(key string, value interface{})
@@ -28,3 +52,17 @@ type IConnection interface {
 	//移除链接属性
 	RemoveProperty(key string)
 }
+
+//ITCPConn 可选接口，底层为TCP套接字的连接(*net.TCPConn)实现该接口，用于调整TCP参数
+type ITCPConn interface {
+	//设置是否开启TCP keepalive
+	SetKeepAlive(keepalive bool) error
+	//设置TCP keepalive探测间隔
+	SetKeepAlivePeriod(d time.Duration) error
+	//设置是否关闭Nagle算法
+	SetNoDelay(noDelay bool) error
+	//设置系统读缓冲区大小
+	SetReadBuffer(bytes int) error
+	//设置系统写缓冲区大小
+	SetWriteBuffer(bytes int) error
+}
@@ -0,0 +1,7 @@
+package iface
+
+//IConnIDGenerator 连接ID生成器
+type IConnIDGenerator interface {
+	//生成下一个连接ID，inUse判断ID是否仍被存活的连接使用，生成器应跳过这些ID
+	NextID(inUse func(connID uint32) bool) uint32
+}
@@ -1,8 +1,12 @@
 package iface
 
+import "io"
+
 //IDataPack 封包和拆包接口
 type IDataPack interface {
-	GetHeadLen() uint32                //获取包头长度方法
-	Pack(msg IMessage) ([]byte, error) //封包方法
-	Unpack([]byte) (IMessage, error)   //拆包方法
+	GetHeadLen() uint32                    //获取包头长度方法
+	GetPkgLen(head []byte) (uint32, error) //根据包头计算完整包的长度(包头+包体+包尾)
+	Pack(msg IMessage) ([]byte, error)     //封包方法
+	Unpack([]byte) (IMessage, error)       //拆包方法
+	Decode(r io.Reader) (IMessage, error)  //从r中读取并拆出一个完整的消息包，阻塞直到读满整个包
 }
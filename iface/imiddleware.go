@@ -0,0 +1,14 @@
+package iface
+
+//HandlerFunc 处理一个请求的方法，返回错误时向客户端回复错误响应
+type HandlerFunc func(request IRequest) error
+
+//Middleware 中间件，包装下一个HandlerFunc；不调用next并返回错误即可中断请求的处理
+type Middleware func(next HandlerFunc) HandlerFunc
+
+//IRouterGroup 路由分组，组内的路由共享该组及其上级分组的中间件
+type IRouterGroup interface {
+	Use(middlewares ...Middleware)                //为该组添加中间件
+	Group(middlewares ...Middleware) IRouterGroup //创建子分组，子分组继承该组的中间件
+	AddRouter(cmd string, router IRouter)         //在该组中注册路由
+}
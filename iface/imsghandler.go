@@ -1,9 +1,24 @@
 package iface
 
+import (
+	"context"
+	"time"
+)
+
 //IMsgHandle 消息管理抽象层
 type IMsgHandle interface {
-	DoMsgHandler(request IRequest)          //马上以非阻塞方式处理消息
-	AddRouter(msgID string, router IRouter) //为消息添加具体的处理逻辑
-	StartWorkerPool()                       //启动worker工作池
-	SendMsgToTaskQueue(request IRequest)    //将消息交给TaskQueue,由worker进行处理
+	DoMsgHandler(request IRequest)                                     //马上以非阻塞方式处理消息
+	AddRouter(msgID string, router IRouter)                            //为消息添加具体的处理逻辑
+	StartWorkerPool()                                                  //启动worker工作池
+	SendMsgToTaskQueue(request IRequest)                               //将消息交给TaskQueue,由worker进行处理
+	Shutdown(ctx context.Context) error                                //等待已入队的请求处理完毕后停止worker工作池
+	Stop()                                                             //立即停止worker工作池
+	Use(middlewares ...Middleware)                                     //添加全局中间件
+	Group(middlewares ...Middleware) IRouterGroup                      //创建路由分组
+	SetOnPanic(func(request IRequest, err interface{}))                //设置处理请求发生panic时的Hook函数
+	SetResponseEncoder(encoder ResponseEncoder)                        //设置错误响应的编码方法
+	SetNotFoundHandler(handler NotFoundHandler)                        //设置找不到路由时的响应方法
+	SetErrorHandler(handler ErrorHandler)                              //设置处理请求出错时的响应方法
+	SetRouteTimeout(cmd string, timeout time.Duration)                 //设置路由的超时时间，作为请求Context的截止时间，超时后回复错误响应
+	SetOnHandlerTimeout(func(request IRequest, timeout time.Duration)) //设置处理请求超时时的Hook函数
 }
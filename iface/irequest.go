@@ -1,6 +1,8 @@
 package iface
 
 import (
+	"context"
+
 	"github.com/ajdwfnhaps/easy-tcp-server/dto"
 )
 
@@ -10,4 +12,5 @@ type IRequest interface {
 	GetMsg() IMessage           //接收到的消息
 	GetRet() dto.Result         //接收到的消息反序列化的结果
 	GetRouterCmd() string       //获取路由路径
+	Context() context.Context   //请求的Context，连接关闭或超过路由的超时时间时取消
 }
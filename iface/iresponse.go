@@ -0,0 +1,12 @@
+package iface
+
+import "github.com/ajdwfnhaps/easy-tcp-server/dto"
+
+//ResponseEncoder 将响应结果编码为发送给客户端的包体数据
+type ResponseEncoder func(ret dto.Result) ([]byte, error)
+
+//NotFoundHandler 找不到请求cmd对应的路由时，生成回复给客户端的响应结果
+type NotFoundHandler func(request IRequest) dto.Result
+
+//ErrorHandler 处理请求返回错误时，生成回复给客户端的响应结果
+type ErrorHandler func(request IRequest, err error) dto.Result
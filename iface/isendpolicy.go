@@ -0,0 +1,38 @@
+package iface
+
+import "time"
+
+//OverflowPolicy 发送队列已满时的处理策略
+type OverflowPolicy int
+
+const (
+	//OverflowBlock 阻塞等待队列空出位置，超过等待时间时丢弃当前消息
+	OverflowBlock OverflowPolicy = iota
+	//OverflowDropNewest 丢弃当前消息
+	OverflowDropNewest
+	//OverflowDropOldest 丢弃队列中最早的消息，放入当前消息
+	OverflowDropOldest
+	//OverflowDisconnect 丢弃当前消息并关闭慢消费者的连接
+	OverflowDisconnect
+)
+
+//String 策略名称，与配置项send_overflow_policy的取值一致
+func (p OverflowPolicy) String() string {
+	switch p {
+	case OverflowBlock:
+		return "block"
+	case OverflowDropNewest:
+		return "drop_newest"
+	case OverflowDropOldest:
+		return "drop_oldest"
+	case OverflowDisconnect:
+		return "disconnect"
+	}
+	return "unknown"
+}
+
+//SendPolicy 发送消息的背压策略
+type SendPolicy struct {
+	Overflow OverflowPolicy //发送队列已满时的处理策略
+	Timeout  time.Duration  //等待发送队列空出位置的最长时间；OverflowBlock时0为一直等待，其他策略的无缓冲发送(SendMsg)只在大于0时等待
+}
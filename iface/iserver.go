@@ -1,36 +1,90 @@
 package iface
 
-import "github.com/ajdwfnhaps/easy-logrus/logger"
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/ajdwfnhaps/easy-logrus/logger"
+)
 
 //IServer 定义服务器接口
 type IServer interface {
-	//启动服务器方法
-	Start()
+	//启动服务器方法，同步绑定监听地址，绑定失败时返回错误
+	Start() error
 	//停止服务器方法
 	Stop()
-	//开启业务服务方法
-	Serve()
+	//优雅停止服务器：停止接收新连接，处理完已入队的请求并发送完缓冲消息后再关闭连接
+	Shutdown(ctx context.Context) error
+	//开启业务服务方法，阻塞直到服务关闭
+	Serve() error
+	//绑定监听地址并运行服务，阻塞直到服务关闭，关闭后返回ErrServerClosed
+	ListenAndServe() error
+	//获取服务实际监听的地址
+	Addr() net.Addr
+	//获取全部监听器，第一个为Server自身的地址
+	Listeners() []IListener
+	//使用已建立的连接提供服务，如net.Pipe或自定义传输的连接
+	ServeConn(conn net.Conn)
 	//路由功能：给当前服务注册一个路由业务方法，供客户端链接处理使用
 	AddRouter(cmd string, router IRouter)
+	//添加全局中间件，按添加顺序由外到内包装所有请求的处理
+	Use(middlewares ...Middleware)
+	//创建路由分组，组内路由共享该组的中间件
+	Group(middlewares ...Middleware) IRouterGroup
 	//得到链接管理
 	GetConnMgr() IConnManager
 	//设置该Server的连接创建时Hook函数
 	SetOnConnStart(func(IConnection))
-	//设置该Server的连接断开时的Hook函数
+	//设置该Server的连接断开时的Hook函数，只对调用过OnConnStart的连接调用
 	SetOnConnStop(func(IConnection))
+	//设置该Server的连接断开时携带关闭原因的Hook函数，在OnConnStop之后调用
+	SetOnConnClosed(func(conn IConnection, reason CloseReason))
 	//调用连接OnConnStart Hook函数
 	CallOnConnStart(conn IConnection)
-	//调用连接OnConnStop Hook函数
+	//调用连接OnConnStop及OnConnClosed Hook函数
 	CallOnConnStop(conn IConnection)
+	//设置该Server拒绝接入连接时的Hook函数，reason为拒绝的原因
+	SetOnConnRejected(func(addr net.Addr, reason error))
+	//调用OnConnRejected Hook函数
+	CallOnConnRejected(addr net.Addr, reason error)
 	//设置使用日志框架
 	SetLogger(logger logger.ILogger)
 	//获取日志框架
 	GetLogger() logger.ILogger
 	//广播
 	Broadcast(data []byte)
+	//设置封包拆包实例，对之后建立的连接生效
+	SetDataPack(dp IDataPack)
+	//获取封包拆包实例
+	GetDataPack() IDataPack
+	//设置处理请求发生panic时的Hook函数
+	SetOnPanic(func(request IRequest, err interface{}))
+	//设置错误响应的编码方法
+	SetResponseEncoder(encoder ResponseEncoder)
+	//设置找不到路由时的响应方法
+	SetNotFoundHandler(handler NotFoundHandler)
+	//设置处理请求出错时的响应方法
+	SetErrorHandler(handler ErrorHandler)
+	//设置路由的超时时间，从开始处理请求时计时，作为请求Context的截止时间，超时后回复错误响应并释放worker
+	SetRouteTimeout(cmd string, timeout time.Duration)
+	//设置处理请求超时时的Hook函数，可用于记录慢请求的指标
+	SetOnHandlerTimeout(func(request IRequest, timeout time.Duration))
+	//设置生成服务端心跳消息的方法
+	SetHeartbeatMsgFunc(func(conn IConnection) []byte)
 
 	//设置该Server成功启动后Hook函数
 	SetOnServerStarted(func(s IServer))
 	//调用OnServerStarted Hook函数
 	CallOnServerStarted(s IServer)
 }
+
+//IListener 服务的一个监听器
+type IListener interface {
+	//获取监听器名称
+	Name() string
+	//获取监听器实际监听的地址
+	Addr() net.Addr
+	//获取当前监听器接入的连接数
+	ConnCount() int
+}
@@ -2,13 +2,17 @@ package impl
 
 import (
 	"bufio"
-	"bytes"
-	"encoding/binary"
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"net"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/ajdwfnhaps/easy-logrus/logger"
 	"github.com/ajdwfnhaps/easy-tcp-server/dto"
@@ -18,22 +22,39 @@ import (
 
 //Connection tcp连接
 type Connection struct {
+	//最后一次收到客户端数据的时间(UnixNano)，原子操作，放在首位保证64位对齐
+	lastActivity int64
+	//因发送队列已满被丢弃的消息数量，原子操作
+	dropped uint64
 	//当前Conn属于哪个Server
 	TcpServer iface.IServer
-	//当前连接的socket TCP套接字
-	Conn *net.TCPConn
+	//当前连接底层的原始连接，TCP时为*net.TCPConn
+	Conn net.Conn
+	//实际读写数据的连接，启用TLS时为包装Conn的tls.Conn，否则为Conn本身
+	rw net.Conn
+	//接入当前连接的监听器
+	listener *listener
+	//经过PROXY协议代理时为读取头部的连接
+	proxy *proxyConn
+	//释放占用的客户端IP连接数，由closeLock保护
+	releaseIP func()
 	//当前连接的ID 也可以称作为SessionID，ID全局唯一
 	ConnID uint32
-	//当前连接的关闭状态
-	isClosed bool
+	//保证连接只关闭一次
+	closeOnce sync.Once
+	//连接的Context，连接关闭时取消
+	ctx    context.Context
+	cancel context.CancelFunc
 	//消息管理MsgId和对应处理方法的消息管理模块
 	MsgHandler iface.IMsgHandle
-	//告知该链接已经退出/停止的channel
+	//告知该链接已经退出/停止的channel，连接关闭时close，Writer及阻塞中的发送随之退出
 	ExitBuffChan chan bool
 	//无缓冲管道，用于读、写两个goroutine之间的消息通信
 	msgChan chan []byte
 	//有关冲管道，用于读、写两个goroutine之间的消息通信
 	msgBuffChan chan []byte
+	//发送队列已满时的背压策略
+	sendPolicy iface.SendPolicy
 
 	//链接属性
 	property map[string]interface{}
@@ -41,26 +62,100 @@ type Connection struct {
 	propertyLock sync.RWMutex
 	//日志
 	logger logger.ILogger
+	//封包拆包实例，由Server统一指定
+	dataPack iface.IDataPack
+	//连接关闭的原因及底层错误，如CloseProtocolError、ErrPacketTooLarge
+	closeReason iface.CloseReason
+	//是否已完成握手并开始工作，未启动的连接关闭时不调用OnConnStop
+	started bool
+	//保护closeReason、started的锁
+	closeLock sync.RWMutex
+
+	//是否已停止读取，优雅关闭时使用，原子操作
+	draining int32
+	//close时通知Writer发送完缓冲消息后退出
+	drainChan chan struct{}
+	//保证drainChan只关闭一次
+	drainOnce sync.Once
+	//Writer退出时close
+	writerDone chan struct{}
+	//Reader退出时close
+	readerDone chan struct{}
+	//写超时，0为不限制
+	writeTimeout time.Duration
+
+	//服务端主动请求的序列号计数
+	callSeq uint32
+	//等待客户端响应的请求，key为seqno，连接关闭后为nil
+	calls map[string]chan dto.Result
+	//保护calls的锁
+	callLock sync.Mutex
 }
 
+var (
+	//ErrConnClosed 连接已关闭
+	ErrConnClosed = errors.New("connection closed")
+	//ErrSendQueueFull 发送队列已满，消息按背压策略被丢弃
+	ErrSendQueueFull = errors.New("send queue full")
+	//DefaultCallTimeout Call的ctx未设置超时时间时使用的默认超时时间
+	DefaultCallTimeout = 10 * time.Second
+)
+
+//shutdownChecker 可判断是否正在停止的Server
+type shutdownChecker interface {
+	shuttingDown() bool
+}
+
+//sendPolicyProvider 提供连接发送背压策略的对象
+type sendPolicyProvider interface {
+	sendPolicy() iface.SendPolicy
+}
+
+//callSeqnoPrefix 服务端主动请求的seqno前缀，避免与客户端请求的seqno冲突
+const callSeqnoPrefix = "srv-"
+
 //NewConntion 创建连接的方法
-func NewConntion(server iface.IServer, conn *net.TCPConn, connID uint32, msgHandler iface.IMsgHandle) *Connection {
+func NewConntion(server iface.IServer, conn net.Conn, connID uint32, msgHandler iface.IMsgHandle) *Connection {
+	c := newConnection(server, conn, conn, connID, msgHandler)
+	//将新创建的Conn添加到链接管理中
+	c.TcpServer.GetConnMgr().Add(c)
+	return c
+}
+
+//newConnection 创建连接，rw为实际读写数据的连接。
+//连接加入链接管理后即可能被其他goroutine关闭，调用方需设置好全部字段后再调用GetConnMgr().Add
+func newConnection(server iface.IServer, conn net.Conn, rw net.Conn, connID uint32, msgHandler iface.IMsgHandle) *Connection {
+	//使用所属Server的配置，无法获取时使用全局默认配置
+	cfg := utils.GlobalObject
+	if p, ok := server.(configProvider); ok {
+		cfg = p.config()
+	}
+
 	//初始化Conn属性
 	c := &Connection{
 		TcpServer:    server,
 		Conn:         conn,
+		rw:           rw,
 		ConnID:       connID,
-		isClosed:     false,
 		MsgHandler:   msgHandler,
-		ExitBuffChan: make(chan bool, 1),
+		ExitBuffChan: make(chan bool),
 		msgChan:      make(chan []byte),
-		msgBuffChan:  make(chan []byte, utils.GlobalObject.MaxMsgChanLen),
+		msgBuffChan:  make(chan []byte, cfg.MaxMsgChanLen),
 		property:     make(map[string]interface{}),
+		drainChan:    make(chan struct{}),
+		writerDone:   make(chan struct{}),
+		readerDone:   make(chan struct{}),
+		writeTimeout: time.Duration(cfg.WriteTimeout) * time.Second,
+		lastActivity: time.Now().UnixNano(),
+		calls:        make(map[string]chan dto.Result),
 	}
 
+	c.ctx, c.cancel = context.WithCancel(context.Background())
 	c.logger = c.TcpServer.GetLogger()
-	//将新创建的Conn添加到链接管理中
-	c.TcpServer.GetConnMgr().Add(c)
+	c.dataPack = c.TcpServer.GetDataPack()
+	if p, ok := server.(sendPolicyProvider); ok {
+		c.sendPolicy = p.sendPolicy()
+	}
 	return c
 }
 
@@ -68,26 +163,37 @@ func NewConntion(server iface.IServer, conn *net.TCPConn, connID uint32, msgHand
 func (c *Connection) StartWriter() {
 	c.logger.Info("[Tcp Writer Goroutine is running]")
 	defer c.logger.Info(c.RemoteAddr().String(), "[Tcp conn Writer exit!]")
+	defer close(c.writerDone)
 
 	for {
 		select {
 		case data := <-c.msgChan:
 			//有数据要写给客户端
-			if _, err := c.Conn.Write(data); err != nil {
+			if err := c.write(data); err != nil {
 				c.logger.Error("Send Data error:, ", err, " Conn Writer exit")
+				c.stopWithReason(iface.CloseWriteError, err)
 				return
 			}
 			//fmt.Printf("Send data succ! data = %+v\n", data)
-		case data, ok := <-c.msgBuffChan:
-			if ok {
-				//有数据要写给客户端
-				if _, err := c.Conn.Write(data); err != nil {
-					c.logger.Error("Send Buff Data error:, ", err, " Conn Writer exit")
+		case data := <-c.msgBuffChan:
+			//有数据要写给客户端
+			if err := c.write(data); err != nil {
+				c.logger.Error("Send Buff Data error:, ", err, " Conn Writer exit")
+				c.stopWithReason(iface.CloseWriteError, err)
+				return
+			}
+		case <-c.drainChan:
+			//发送完缓冲中剩余的消息后退出
+			for {
+				select {
+				case data := <-c.msgBuffChan:
+					if err := c.write(data); err != nil {
+						c.logger.Error("Send Buff Data error:, ", err, " Conn Writer exit")
+						return
+					}
+				default:
 					return
 				}
-			} else {
-				c.logger.Info("msgBuffChan is Closed")
-				break
 			}
 		case <-c.ExitBuffChan:
 			return
@@ -95,62 +201,56 @@ func (c *Connection) StartWriter() {
 	}
 }
 
+//write 将数据写入socket，设置了写超时时每次写入前更新写超时时间
+func (c *Connection) write(data []byte) error {
+	if c.writeTimeout > 0 {
+		c.rw.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	}
+	_, err := c.rw.Write(data)
+	return err
+}
+
 //StartReader 读消息Goroutine，用于从客户端中读取数据
 func (c *Connection) StartReader() {
 	c.logger.Info("[Tcp Reader Goroutine is running]")
+	defer close(c.readerDone)
 	defer c.logger.Info(c.RemoteAddr().String(), "[Tcp conn Reader exit!]")
-	defer c.Stop()
-
-	for {
-
-		reader := bufio.NewReader(c.Conn)
-		bodySizeBytes, err := reader.Peek(4)
-		if err != nil {
-			c.logger.Error("reader.Peek error.", err)
-			break
+	//导致Reader退出的原因，客户端正常关闭时readErr为nil
+	readCode, readErr := iface.CloseEOF, error(nil)
+	defer func() {
+		//优雅关闭时由Server在发送完缓冲消息后关闭连接
+		if atomic.LoadInt32(&c.draining) == 0 {
+			c.stopWithReason(readCode, readErr)
 		}
+	}()
 
-		c.logger.Info("读取到客户端[", c.RemoteAddr(), "]发过来的新消息...")
+	//每个连接只持有一个带缓冲的Reader，跨包读取的字节不会丢失
+	reader := bufio.NewReader(c.rw)
 
-		bodySizeBuff := bytes.NewBuffer(bodySizeBytes)
-		var bodySize uint32
-		err = binary.Read(bodySizeBuff, binary.LittleEndian, &bodySize)
+	for {
+		//阻塞直到读满一个完整的包
+		msg, err := c.dataPack.Decode(reader)
 		if err != nil {
 			if err == io.EOF {
-				c.logger.Info("binary.Read error.跳出循环", err)
-				break // 跳出循环
+				c.logger.Info("客户端[", c.RemoteAddr(), "]已关闭连接")
 			} else {
-				c.logger.Error("binary.Read error.", err)
-				continue
+				c.logger.Error("decode msg error ", err)
+				readCode, readErr = readCloseCode(err), err
 			}
-		}
-
-		dataPacker := NewDataPack()
-		pkgLength := bodySize + dataPacker.GetHeadLen() //包头长度24
-
-		// Buffered返回缓冲中现有的可读取的字节数。
-		if uint32(reader.Buffered()) < pkgLength {
-			c.logger.Warn("binary.Read 读取完整包失败,丢弃包.\r\n读取包的字节数：", reader.Buffered(), ",按自定义协议计算的包长度：", pkgLength)
-			continue
-		}
-
-		//c.Conn.SetReadDeadline(time.Now().Add(time.Duration(10) * time.Second))
-
-		data := make([]byte, pkgLength)
-		if _, err := io.ReadFull(reader, data); err != nil {
-			c.logger.Error("read msg data error ", err)
 			break
 		}
 
-		msg, err := dataPacker.Unpack(data)
-		if err != nil {
-			c.logger.Error("unpack error ", err)
-			break
-		}
+		atomic.StoreInt64(&c.lastActivity, time.Now().UnixNano())
+		c.logger.Info("读取到客户端[", c.RemoteAddr(), "]发过来的新消息...")
 
 		var jsonObj dto.Result
 		json.Unmarshal(msg.GetBody(), &jsonObj)
 
+		//服务端主动请求的响应，直接交给等待中的Call，不经过路由
+		if c.deliverReply(jsonObj) {
+			continue
+		}
+
 		//得到当前客户端请求的Request数据
 		req := Request{
 			conn: c,
@@ -158,18 +258,71 @@ func (c *Connection) StartReader() {
 			ret:  jsonObj,
 		}
 
-		if utils.GlobalObject.WorkerPoolSize > 0 {
-			//已经启动工作池机制，将消息交给Worker处理
-			c.MsgHandler.SendMsgToTaskQueue(&req)
-		} else {
-			//从绑定好的消息和对应的处理方法中执行对应的Handle方法
-			go c.MsgHandler.DoMsgHandler(&req)
-		}
+		//将消息交给Worker处理，未启动工作池机制时由MsgHandler直接开启goroutine处理
+		c.MsgHandler.SendMsgToTaskQueue(&req)
 	}
 }
 
 //Start 启动连接，让当前连接开始工作
 func (c *Connection) Start() {
+	//0 经过代理的连接先读取PROXY协议头部，获取真实的客户端地址
+	if c.proxy != nil {
+		if err := c.proxy.readHeader(ProxyHeaderTimeout); err != nil {
+			c.logger.Error("read proxy protocol header error ", err, ", ProxyAddr:", c.proxy.ProxyAddr())
+			c.stopWithReason(iface.CloseProtocolError, err)
+			return
+		}
+		//优雅关闭时保留stopReading设置的读超时
+		if atomic.LoadInt32(&c.draining) == 0 {
+			c.proxy.Conn.SetReadDeadline(time.Time{})
+		}
+		if a, ok := c.TcpServer.(connAdmitter); ok {
+			release, err := a.admitIP(c.RemoteAddr())
+			if err != nil {
+				c.logger.Warnf("拒绝客户端[%s]的连接: %s", c.RemoteAddr(), err)
+				c.TcpServer.CallOnConnRejected(c.RemoteAddr(), err)
+				//与未经代理的连接一致只调用OnConnRejected，连接尚未启动，关闭时不调用OnConnStop
+				c.stopWithReason(iface.CloseRejected, err)
+				return
+			}
+			//连接可能已被其他goroutine关闭，此时stopWithReason不会再释放，由此处释放
+			c.closeLock.Lock()
+			closed := c.isClosed()
+			if !closed {
+				c.releaseIP = release
+			}
+			c.closeLock.Unlock()
+			if closed {
+				if release != nil {
+					release()
+				}
+				return
+			}
+		}
+	}
+	//0 TLS连接先完成握手，并将已校验的客户端证书信息保存到连接属性中
+	if tlsConn, ok := c.rw.(*tls.Conn); ok {
+		if err := c.handshake(tlsConn); err != nil {
+			c.logger.Error("tls handshake error ", err, ", ClientAddr:", c.RemoteAddr())
+			c.stopWithReason(iface.CloseHandshakeError, err)
+			return
+		}
+	}
+	//0 标记为已启动，此后关闭连接时才调用OnConnStop，与OnConnStart成对出现
+	c.closeLock.Lock()
+	if c.isClosed() {
+		c.closeLock.Unlock()
+		return
+	}
+	//握手期间Server开始优雅关闭，连接不再启动
+	if atomic.LoadInt32(&c.draining) == 1 {
+		c.closeLock.Unlock()
+		c.Stop()
+		return
+	}
+	c.started = true
+	c.closeLock.Unlock()
+
 	//1 开启用户从客户端读取数据流程的Goroutine
 	go c.StartReader()
 	//2 开启用于写回客户端数据流程的Goroutine
@@ -178,81 +331,374 @@ func (c *Connection) Start() {
 	c.TcpServer.CallOnConnStart(c)
 }
 
-//Stop 停止连接，结束当前连接状态M
+//Stop 停止连接，结束当前连接状态M，可在任意goroutine中重复调用。
+//关闭原因为CloseKicked，服务停止过程中关闭时为CloseServerShutdown
 func (c *Connection) Stop() {
-	c.logger.Info("tcp客户端断开连接...ConnID = ", c.ConnID, ", ClientAddr:", c.RemoteAddr())
-	//如果当前链接已经关闭
-	if c.isClosed == true {
-		return
+	code := iface.CloseKicked
+	if s, ok := c.TcpServer.(shutdownChecker); ok && s.shuttingDown() {
+		code = iface.CloseServerShutdown
 	}
-	c.isClosed = true
-
-	//如果用户注册了该链接的关闭回调业务，那么在此刻应该显示调用
-	c.TcpServer.CallOnConnStop(c)
+	c.stopWithReason(code, nil)
+}
 
-	// 关闭socket链接
-	c.Conn.Close()
-	//关闭Writer
-	c.ExitBuffChan <- true
+//stopWithReason 因code、err停止连接，OnConnStop中可通过CloseReason、GetCloseErr获取关闭原因。
+//只有第一次调用生效，返回时连接已关闭；OnConnStop在closeOnce之外调用，Hook中再次Stop不会死锁
+func (c *Connection) stopWithReason(code iface.CloseCode, err error) {
+	first := false
+	c.closeOnce.Do(func() {
+		first = true
+
+		c.closeLock.Lock()
+		c.closeReason = iface.CloseReason{Code: code, Err: err}
+		c.closeLock.Unlock()
+
+		//通知Writer及阻塞中的发送退出，发送管道不关闭，之后的发送返回ErrConnClosed
+		close(c.ExitBuffChan)
+		//取消连接的Context，正在处理的请求可以及时中止
+		c.cancel()
+		// 关闭socket链接
+		c.rw.Close()
+
+		//结束所有等待客户端响应的请求
+		c.callLock.Lock()
+		for _, ch := range c.calls {
+			close(ch)
+		}
+		c.calls = nil
+		c.callLock.Unlock()
+	})
+	if !first {
+		return
+	}
+	c.logger.Info("tcp客户端断开连接...ConnID = ", c.ConnID, ", ClientAddr:", c.RemoteAddr(), ", reason:", c.CloseReason())
+
+	//如果用户注册了该链接的关闭回调业务，那么在此刻应该显示调用，未启动的连接没有调用过OnConnStart，同样不调用
+	c.closeLock.RLock()
+	started := c.started
+	c.closeLock.RUnlock()
+	if started {
+		c.TcpServer.CallOnConnStop(c)
+	}
 
 	//将链接从连接管理器中删除
 	c.TcpServer.GetConnMgr().Remove(c)
+	if c.listener != nil {
+		atomic.AddInt64(&c.listener.conns, -1)
+	}
+	c.closeLock.Lock()
+	releaseIP := c.releaseIP
+	c.releaseIP = nil
+	c.closeLock.Unlock()
+	if releaseIP != nil {
+		releaseIP()
+	}
+}
 
-	//关闭该链接全部管道
-	close(c.ExitBuffChan)
-	close(c.msgBuffChan)
+//isClosed 连接是否已关闭
+func (c *Connection) isClosed() bool {
+	select {
+	case <-c.ExitBuffChan:
+		return true
+	default:
+		return false
+	}
 }
 
-//GetTCPConnection 从当前连接获取原始的socket TCPConn
-func (c *Connection) GetTCPConnection() *net.TCPConn {
+//stopReading 停止读取客户端新的请求，Writer继续工作。
+//尚未完成PROXY头部读取或TLS握手的连接没有Writer，直接关闭
+func (c *Connection) stopReading() {
+	c.closeLock.Lock()
+	atomic.StoreInt32(&c.draining, 1)
+	started := c.started
+	c.closeLock.Unlock()
+	if !started {
+		c.Stop()
+		return
+	}
+	//让阻塞中的读操作立即返回
+	c.rw.SetReadDeadline(time.Now())
+}
+
+//waitReading 等待Reader退出，此后该连接不会再有新的请求交给MsgHandler，ctx超时则返回ctx的错误
+func (c *Connection) waitReading(ctx context.Context) error {
+	//stopReading之后未启动的连接不会再启动Reader
+	c.closeLock.RLock()
+	started := c.started
+	c.closeLock.RUnlock()
+	if !started {
+		return nil
+	}
+
+	select {
+	case <-c.readerDone:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+//flushAndStop 等待Writer发送完缓冲中的消息后关闭连接，ctx超时则直接关闭
+func (c *Connection) flushAndStop(ctx context.Context) error {
+	c.drainOnce.Do(func() {
+		close(c.drainChan)
+	})
+
+	select {
+	case <-c.writerDone:
+		c.Stop()
+		return nil
+	case <-c.ExitBuffChan:
+		//连接已关闭或未启动过，Writer不会再发送
+		return nil
+	case <-ctx.Done():
+		c.Stop()
+		return ctx.Err()
+	}
+}
+
+//GetConnection 获取当前连接底层的原始连接
+//启用TLS时直接读写该连接会破坏加密数据流，收发消息请使用SendMsg、SendBuffMsg
+func (c *Connection) GetConnection() net.Conn {
 	return c.Conn
 }
 
+//GetTCPConnection 从当前连接获取原始的socket TCPConn，底层不是TCP连接时返回nil
+//
+//Deprecated: 使用GetConnection
+func (c *Connection) GetTCPConnection() *net.TCPConn {
+	tcpConn, _ := c.Conn.(*net.TCPConn)
+	return tcpConn
+}
+
+//GetCloseErr 获取导致连接关闭的错误，连接未关闭或正常关闭时为nil
+func (c *Connection) GetCloseErr() error {
+	return c.CloseReason().Err
+}
+
+//CloseReason 获取连接关闭的原因，连接未关闭时Code为iface.CloseNone
+func (c *Connection) CloseReason() iface.CloseReason {
+	c.closeLock.RLock()
+	defer c.closeLock.RUnlock()
+
+	return c.closeReason
+}
+
+//readCloseCode 根据Reader的错误得到关闭原因，封包非法时为协议错误
+func readCloseCode(err error) iface.CloseCode {
+	if errors.Is(err, ErrPacketTooLarge) || errors.Is(err, ErrBadHeader) {
+		return iface.CloseProtocolError
+	}
+	return iface.CloseReadError
+}
+
+//GetLastActivity 获取最后一次收到客户端数据的时间
+func (c *Connection) GetLastActivity() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&c.lastActivity))
+}
+
 //GetConnID 获取当前连接ID
 func (c *Connection) GetConnID() uint32 {
 	return c.ConnID
 }
 
-//RemoteAddr 获取远程客户端地址信息
+//Context 获取连接的Context，连接关闭时取消
+func (c *Connection) Context() context.Context {
+	return c.ctx
+}
+
+//GetListener 获取接入当前连接的监听器，通过ServeConn接入的连接返回nil
+func (c *Connection) GetListener() iface.IListener {
+	if c.listener == nil {
+		return nil
+	}
+	return c.listener
+}
+
+//RemoteAddr 获取远程客户端地址信息，经过PROXY协议代理时为真实的客户端地址
 func (c *Connection) RemoteAddr() net.Addr {
-	return c.Conn.RemoteAddr()
+	return c.rw.RemoteAddr()
+}
+
+//GetProxyAddr 获取PROXY协议代理的地址，未经过代理时返回nil
+func (c *Connection) GetProxyAddr() net.Addr {
+	if c.proxy == nil {
+		return nil
+	}
+	return c.proxy.ProxyAddr()
 }
 
 //SendMsg 直接将Message数据发送数据给远程的TCP客户端
 func (c *Connection) SendMsg(data []byte) error {
-	if c.isClosed == true {
-		return errors.New("Connection closed when send msg")
+	if c.isClosed() {
+		return ErrConnClosed
 	}
 	//将data封包，并且发送
 	msg := NewMsgPackage(data)
-	dataPacker := NewDataPack()
-	data, err := dataPacker.Pack(msg)
+	data, err := c.dataPack.Pack(msg)
 	if err != nil {
 		return err
 	}
-	//写回客户端
-	c.msgChan <- data
-
-	return nil
+	//写回客户端，Writer繁忙时按背压策略处理
+	return c.enqueue(c.msgChan, data, c.sendPolicy)
 }
 
-//SendBuffMsg SendBuffMsg
+//SendBuffMsg 将Message数据放入发送缓冲，缓冲已满时按Server的背压策略处理
 func (c *Connection) SendBuffMsg(data []byte) error {
-	if c.isClosed == true {
-		return errors.New("Connection closed when send buff msg")
+	return c.SendBuffMsgWithPolicy(data, c.sendPolicy)
+}
+
+//SendBuffMsgWithPolicy 将Message数据放入发送缓冲，缓冲已满时按policy处理
+func (c *Connection) SendBuffMsgWithPolicy(data []byte, policy iface.SendPolicy) error {
+	if c.isClosed() {
+		return ErrConnClosed
 	}
 	//将data封包，并且发送
 	msg := NewMsgPackage(data)
-	dataPacker := NewDataPack()
-	data, err := dataPacker.Pack(msg)
+	data, err := c.dataPack.Pack(msg)
 	if err != nil {
 		return err
 	}
 
 	//写回客户端
-	c.msgBuffChan <- data
+	return c.enqueue(c.msgBuffChan, data, policy)
+}
 
-	return nil
+//enqueue 将数据放入发送队列，队列已满时按policy处理。
+//OverflowBlock一直等待或等待最多policy.Timeout；其他策略下无缓冲队列(SendMsg)只在policy.Timeout大于0时等待Writer，
+//超时或不等待时视为队列已满，避免向不读取数据的客户端发送时阻塞worker
+func (c *Connection) enqueue(queue chan []byte, data []byte, policy iface.SendPolicy) error {
+	//1 队列未满时直接放入
+	select {
+	case queue <- data:
+		return nil
+	default:
+	}
+	if policy.Overflow == iface.OverflowBlock || cap(queue) == 0 && policy.Timeout > 0 {
+		if err := c.waitEnqueue(queue, data, policy.Timeout); err != ErrSendQueueFull {
+			return err
+		}
+	}
+
+	//2 队列已满
+	switch policy.Overflow {
+	case iface.OverflowDropOldest:
+		//丢弃队列中最早的消息腾出位置，无缓冲队列没有可丢弃的消息，丢弃当前消息
+		for cap(queue) > 0 {
+			select {
+			case <-queue:
+				atomic.AddUint64(&c.dropped, 1)
+			default:
+			}
+			select {
+			case queue <- data:
+				return nil
+			default:
+			}
+		}
+	case iface.OverflowDisconnect:
+		c.logger.Warnf("客户端[%s]发送队列已满，将会关闭连接", c.RemoteAddr())
+		atomic.AddUint64(&c.dropped, 1)
+		go c.stopWithReason(iface.CloseSendQueueFull, ErrSendQueueFull)
+		return ErrSendQueueFull
+	}
+	atomic.AddUint64(&c.dropped, 1)
+	return ErrSendQueueFull
+}
+
+//waitEnqueue 等待最多timeout将数据放入队列，timeout为0时一直等待。
+//超时返回ErrSendQueueFull，等待期间连接关闭返回ErrConnClosed
+func (c *Connection) waitEnqueue(queue chan []byte, data []byte, timeout time.Duration) error {
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case queue <- data:
+		return nil
+	case <-c.ExitBuffChan:
+		return ErrConnClosed
+	case <-expired:
+		return ErrSendQueueFull
+	}
+}
+
+//GetDroppedCount 获取因发送队列已满被丢弃的消息数量
+func (c *Connection) GetDroppedCount() uint64 {
+	return atomic.LoadUint64(&c.dropped)
+}
+
+//Call 向客户端发送一个请求，并阻塞等待客户端返回相同seqno的响应。
+//seqno由服务端自动生成，响应不经过路由处理；ctx未设置超时时间时使用DefaultCallTimeout，
+//超时返回ctx的错误，等待期间连接关闭返回ErrConnClosed
+func (c *Connection) Call(ctx context.Context, cmd string, data interface{}) (dto.Result, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, DefaultCallTimeout)
+		defer cancel()
+	}
+
+	seqno := fmt.Sprintf("%s%d-%d", callSeqnoPrefix, c.ConnID, atomic.AddUint32(&c.callSeq, 1))
+	replyChan := make(chan dto.Result, 1)
+
+	c.callLock.Lock()
+	if c.calls == nil {
+		c.callLock.Unlock()
+		return dto.Result{}, ErrConnClosed
+	}
+	c.calls[seqno] = replyChan
+	c.callLock.Unlock()
+
+	defer func() {
+		c.callLock.Lock()
+		if c.calls != nil {
+			delete(c.calls, seqno)
+		}
+		c.callLock.Unlock()
+	}()
+
+	body, err := json.Marshal(dto.Result{
+		Cmd:   cmd,
+		Seqno: seqno,
+		Data:  data,
+	})
+	if err != nil {
+		return dto.Result{}, err
+	}
+	if err := c.SendBuffMsg(body); err != nil {
+		return dto.Result{}, err
+	}
+
+	select {
+	case ret, ok := <-replyChan:
+		if !ok {
+			return dto.Result{}, ErrConnClosed
+		}
+		return ret, nil
+	case <-ctx.Done():
+		return dto.Result{}, ctx.Err()
+	}
+}
+
+//deliverReply 如果ret是服务端主动请求的响应，则交给等待中的Call并返回true。
+//Call已超时返回的迟到响应同样返回true，直接丢弃，不经过路由
+func (c *Connection) deliverReply(ret dto.Result) bool {
+	if !strings.HasPrefix(ret.Seqno, callSeqnoPrefix) {
+		return false
+	}
+
+	c.callLock.Lock()
+	defer c.callLock.Unlock()
+
+	replyChan, ok := c.calls[ret.Seqno]
+	if !ok {
+		c.logger.Debug("丢弃客户端[", c.RemoteAddr(), "]迟到的响应, cmd = ", ret.Cmd, ", seqno = ", ret.Seqno)
+		return true
+	}
+	delete(c.calls, ret.Seqno)
+	replyChan <- ret
+	return true
 }
 
 //SetProperty 设置链接属性
@@ -281,3 +727,13 @@ func (c *Connection) RemoveProperty(key string) {
 
 	delete(c.property, key)
 }
+
+//ParseOverflowPolicy 解析配置项send_overflow_policy：block、drop_newest、drop_oldest、disconnect
+func ParseOverflowPolicy(s string) (iface.OverflowPolicy, error) {
+	for _, p := range []iface.OverflowPolicy{iface.OverflowBlock, iface.OverflowDropNewest, iface.OverflowDropOldest, iface.OverflowDisconnect} {
+		if p.String() == s {
+			return p, nil
+		}
+	}
+	return iface.OverflowBlock, fmt.Errorf("unknown send overflow policy %q", s)
+}
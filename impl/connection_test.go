@@ -0,0 +1,553 @@
+package impl
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ajdwfnhaps/easy-tcp-server/dto"
+	"github.com/ajdwfnhaps/easy-tcp-server/iface"
+	"github.com/ajdwfnhaps/easy-tcp-server/utils"
+)
+
+//dialTestConn 连接到测试Server，并返回客户端连接及服务端对应的连接
+func dialTestConn(t *testing.T, s *Server) (net.Conn, iface.IConnection) {
+	client, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 300; i++ {
+		for _, conn := range s.ConnMgr.GetAll() {
+			if conn.RemoteAddr().String() == client.LocalAddr().String() {
+				return client, conn
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	client.Close()
+	t.Fatal("server side connection not found")
+	return nil, nil
+}
+
+func TestConnCall(t *testing.T) {
+	s := newTestServer()
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	client, conn := dialTestConn(t, s)
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(3 * time.Second))
+
+	type callResult struct {
+		ret dto.Result
+		err error
+	}
+	resultChan := make(chan callResult, 1)
+	go func() {
+		ret, err := conn.Call(context.Background(), "request_state", map[string]string{"key": "power"})
+		resultChan <- callResult{ret, err}
+	}()
+
+	msg, err := readTestMsg(client, s.GetDataPack())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var req dto.Result
+	if err := json.Unmarshal(msg.GetBody(), &req); err != nil {
+		t.Fatal(err)
+	}
+	if req.Cmd != "request_state" || req.Seqno == "" {
+		t.Fatalf("unexpected request %s", msg.GetBody())
+	}
+
+	reply, _ := json.Marshal(dto.Result{Cmd: "response_state", Seqno: req.Seqno, Data: "on"})
+	if err := writeTestMsg(client, s.GetDataPack(), string(reply)); err != nil {
+		t.Fatal(err)
+	}
+
+	res := <-resultChan
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	if res.ret.Cmd != "response_state" || res.ret.Data != "on" {
+		t.Fatalf("unexpected reply %+v", res.ret)
+	}
+}
+
+func TestConnCallTimeoutAndClose(t *testing.T) {
+	s := newTestServer()
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	client, conn := dialTestConn(t, s)
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := conn.Call(ctx, "request_state", nil); err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+
+	//Call超时后客户端才回复，迟到的响应应被丢弃，不经过路由
+	client.SetDeadline(time.Now().Add(3 * time.Second))
+	msg, err := readTestMsg(client, s.GetDataPack())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var req dto.Result
+	if err := json.Unmarshal(msg.GetBody(), &req); err != nil {
+		t.Fatal(err)
+	}
+	late := `{"cmd":"response_state","seqno":"` + req.Seqno + `"}`
+	if err := writeTestMsg(client, s.GetDataPack(), late); err != nil {
+		t.Fatal(err)
+	}
+	//之后的普通请求按顺序处理，收到的第一个响应应属于该请求
+	if err := writeTestMsg(client, s.GetDataPack(), `{"cmd":"request_ping","seqno":"1"}`); err != nil {
+		t.Fatal(err)
+	}
+	msg, err = readTestMsg(client, s.GetDataPack())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(msg.GetBody()), "request_ping") {
+		t.Fatalf("late reply was routed: %s", msg.GetBody())
+	}
+	client.SetDeadline(time.Time{})
+
+	errChan := make(chan error, 1)
+	go func() {
+		_, err := conn.Call(context.Background(), "request_state", nil)
+		errChan <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+	client.Close()
+
+	select {
+	case err := <-errChan:
+		if err != ErrConnClosed {
+			t.Fatalf("expected ErrConnClosed, got %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("Call did not return after connection closed")
+	}
+
+	if _, err := conn.Call(context.Background(), "request_state", nil); err != ErrConnClosed {
+		t.Fatalf("expected ErrConnClosed after close, got %v", err)
+	}
+}
+
+func TestConnOverPipe(t *testing.T) {
+	s := newTestServer()
+	s.AddRouter("request_echo", &echoRouter{})
+	started := make(chan iface.IConnection, 1)
+	s.SetOnConnStart(func(conn iface.IConnection) {
+		started <- conn
+	})
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	client, server := net.Pipe()
+	defer client.Close()
+	s.ServeConn(server)
+
+	conn := <-started
+	if conn.GetConnection() != server {
+		t.Fatal("GetConnection should return the served conn")
+	}
+	if _, ok := conn.GetConnection().(iface.ITCPConn); ok {
+		t.Fatal("pipe conn must not expose tcp tuning")
+	}
+
+	client.SetDeadline(time.Now().Add(3 * time.Second))
+	req := `{"cmd":"request_echo"}`
+	if err := writeTestMsg(client, s.GetDataPack(), req); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := readTestMsg(client, s.GetDataPack())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(msg.GetBody()) != req {
+		t.Fatalf("unexpected reply %s", msg.GetBody())
+	}
+}
+
+func TestConnTCPTuning(t *testing.T) {
+	s := newTestServer()
+	s.cfg.TCPKeepAlive = 30
+	s.cfg.TCPReadBuffer = 64 * 1024
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	client, conn := dialTestConn(t, s)
+	defer client.Close()
+
+	tcpConn, ok := conn.GetConnection().(iface.ITCPConn)
+	if !ok {
+		t.Fatalf("tcp conn should expose tcp tuning, got %T", conn.GetConnection())
+	}
+	if err := tcpConn.SetNoDelay(false); err != nil {
+		t.Fatal(err)
+	}
+}
+
+//startPipeTestConn 通过net.Pipe接入测试Server，发送缓冲长度为2。
+//先发送m1并等待Writer取出后阻塞在写入上(客户端未读取)，再发送m2、m3填满发送缓冲
+func startPipeTestConn(t *testing.T, policy iface.SendPolicy) (*Server, net.Conn, *Connection) {
+	s := newTestServer()
+	s.cfg.MaxMsgChanLen = 2
+	s.SendPolicy = policy
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	client, server := net.Pipe()
+	s.ServeConn(server)
+	var c *Connection
+	for i := 0; c == nil; i++ {
+		if i > 300 {
+			t.Fatal("server side connection not found")
+		}
+		for _, conn := range s.ConnMgr.GetAll() {
+			c = conn.(*Connection)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := c.SendBuffMsg([]byte("m1")); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; len(c.msgBuffChan) != 0; i++ {
+		if i > 300 {
+			t.Fatal("writer did not take m1")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	for _, m := range []string{"m2", "m3"} {
+		if err := c.SendBuffMsg([]byte(m)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return s, client, c
+}
+
+//expectPipeMsgs 客户端依次读取到msgs
+func expectPipeMsgs(t *testing.T, s *Server, client net.Conn, msgs ...string) {
+	client.SetDeadline(time.Now().Add(3 * time.Second))
+	for _, want := range msgs {
+		msg, err := readTestMsg(client, s.GetDataPack())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(msg.GetBody()) != want {
+			t.Fatalf("expected %s, got %s", want, msg.GetBody())
+		}
+	}
+}
+
+func TestConnBackpressureDropNewest(t *testing.T) {
+	s, client, c := startPipeTestConn(t, iface.SendPolicy{Overflow: iface.OverflowDropNewest})
+	defer s.Stop()
+	defer client.Close()
+
+	if err := c.SendBuffMsg([]byte("m4")); err != ErrSendQueueFull {
+		t.Fatalf("expected ErrSendQueueFull, got %v", err)
+	}
+	if c.GetDroppedCount() != 1 {
+		t.Fatalf("unexpected dropped count %d", c.GetDroppedCount())
+	}
+	expectPipeMsgs(t, s, client, "m1", "m2", "m3")
+}
+
+func TestConnBackpressureDropOldest(t *testing.T) {
+	s, client, c := startPipeTestConn(t, iface.SendPolicy{Overflow: iface.OverflowDropOldest})
+	defer s.Stop()
+	defer client.Close()
+
+	if err := c.SendBuffMsg([]byte("m4")); err != nil {
+		t.Fatal(err)
+	}
+	if c.GetDroppedCount() != 1 {
+		t.Fatalf("unexpected dropped count %d", c.GetDroppedCount())
+	}
+	expectPipeMsgs(t, s, client, "m1", "m3", "m4")
+}
+
+func TestConnBackpressureBlockTimeout(t *testing.T) {
+	s, client, c := startPipeTestConn(t, iface.SendPolicy{Overflow: iface.OverflowBlock, Timeout: 50 * time.Millisecond})
+	defer s.Stop()
+	defer client.Close()
+
+	begin := time.Now()
+	if err := c.SendBuffMsg([]byte("m4")); err != ErrSendQueueFull {
+		t.Fatalf("expected ErrSendQueueFull, got %v", err)
+	}
+	if time.Since(begin) < 50*time.Millisecond {
+		t.Fatal("block policy should wait for the timeout")
+	}
+	//无缓冲发送同样在超时后返回
+	if err := c.SendMsg([]byte("m5")); err != ErrSendQueueFull {
+		t.Fatalf("expected ErrSendQueueFull, got %v", err)
+	}
+	if c.GetDroppedCount() != 2 {
+		t.Fatalf("unexpected dropped count %d", c.GetDroppedCount())
+	}
+
+	//单次发送可以指定不同的策略
+	if err := c.SendBuffMsgWithPolicy([]byte("m6"), iface.SendPolicy{Overflow: iface.OverflowDropNewest}); err != ErrSendQueueFull {
+		t.Fatalf("expected ErrSendQueueFull, got %v", err)
+	}
+	expectPipeMsgs(t, s, client, "m1", "m2", "m3")
+}
+
+func TestConnBackpressureDisconnect(t *testing.T) {
+	s, client, c := startPipeTestConn(t, iface.SendPolicy{Overflow: iface.OverflowDisconnect})
+	defer s.Stop()
+	defer client.Close()
+
+	if err := c.SendBuffMsg([]byte("m4")); err != ErrSendQueueFull {
+		t.Fatalf("expected ErrSendQueueFull, got %v", err)
+	}
+	for i := 0; c.GetCloseErr() != ErrSendQueueFull; i++ {
+		if i > 300 {
+			t.Fatalf("slow consumer should be disconnected, close err %v", c.GetCloseErr())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestConnSendMsgNonBlockPolicies(t *testing.T) {
+	for _, overflow := range []iface.OverflowPolicy{iface.OverflowDropNewest, iface.OverflowDropOldest, iface.OverflowDisconnect} {
+		t.Run(overflow.String(), func(t *testing.T) {
+			s, client, c := startPipeTestConn(t, iface.SendPolicy{Overflow: overflow})
+			defer s.Stop()
+			defer client.Close()
+
+			//客户端不读取，Writer阻塞在写入上，Timeout为0时SendMsg不应等待
+			errChan := make(chan error, 1)
+			go func() { errChan <- c.SendMsg([]byte("m4")) }()
+			select {
+			case err := <-errChan:
+				if err != ErrSendQueueFull {
+					t.Fatalf("expected ErrSendQueueFull, got %v", err)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("SendMsg blocked on a stalled peer")
+			}
+			if c.GetDroppedCount() != 1 {
+				t.Fatalf("unexpected dropped count %d", c.GetDroppedCount())
+			}
+		})
+	}
+}
+
+func TestConnSendPolicyConfig(t *testing.T) {
+	cfg := utils.NewConfig()
+	cfg.SendOverflowPolicy = "drop_oldest"
+	cfg.SendTimeoutMs = 200
+	s := NewServerWithConfig(cfg).(*Server)
+	if s.SendPolicy.Overflow != iface.OverflowDropOldest || s.SendPolicy.Timeout != 200*time.Millisecond {
+		t.Fatalf("unexpected send policy %+v", s.SendPolicy)
+	}
+
+	cfg = utils.NewConfig()
+	cfg.Host = "127.0.0.1"
+	cfg.TcpPort = 0
+	cfg.SendOverflowPolicy = "drop_everything"
+	if err := NewServerWithConfig(cfg).Start(); err == nil {
+		t.Fatal("expected error for unknown send overflow policy")
+	}
+}
+
+func TestConnStopUnblocksSenders(t *testing.T) {
+	s, client, c := startPipeTestConn(t, iface.SendPolicy{Overflow: iface.OverflowBlock})
+	defer s.Stop()
+	defer client.Close()
+
+	//客户端不读取，Writer阻塞在写入上，发送队列已满，发送一直等待
+	errs := make(chan error, 4)
+	for i := 0; i < 2; i++ {
+		go func() { errs <- c.SendMsg([]byte("m")) }()
+		go func() { errs <- c.SendBuffMsg([]byte("m")) }()
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.Stop()
+		}()
+	}
+	wg.Wait()
+
+	for i := 0; i < 4; i++ {
+		select {
+		case err := <-errs:
+			if err != ErrConnClosed {
+				t.Fatalf("expected ErrConnClosed, got %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("sender still blocked after Stop")
+		}
+	}
+	if err := c.SendBuffMsg([]byte("m")); err != ErrConnClosed {
+		t.Fatalf("expected ErrConnClosed after Stop, got %v", err)
+	}
+	if err := c.SendMsg([]byte("m")); err != ErrConnClosed {
+		t.Fatalf("expected ErrConnClosed after Stop, got %v", err)
+	}
+}
+
+func TestConnConcurrentSendAndStop(t *testing.T) {
+	const conns = 20
+
+	s := newTestServer()
+	s.cfg.MaxMsgChanLen = 4
+	started := make(chan iface.IConnection, conns)
+	var stops int64
+	s.SetOnConnStart(func(conn iface.IConnection) {
+		started <- conn
+	})
+	s.SetOnConnStop(func(conn iface.IConnection) {
+		atomic.AddInt64(&stops, 1)
+		//Hook中再次关闭不会死锁
+		conn.Stop()
+	})
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	for i := 0; i < conns; i++ {
+		client, server := net.Pipe()
+		defer client.Close()
+		go io.Copy(ioutil.Discard, client)
+		s.ServeConn(server)
+		conn := <-started
+
+		var wg sync.WaitGroup
+		for j := 0; j < 4; j++ {
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				for conn.SendBuffMsg([]byte("buff")) == nil {
+				}
+			}()
+			go func() {
+				defer wg.Done()
+				for conn.SendMsg([]byte("msg")) == nil {
+				}
+			}()
+		}
+		for j := 0; j < 3; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				time.Sleep(time.Millisecond)
+				conn.Stop()
+			}()
+		}
+
+		done := make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("conn %d: senders did not return after Stop", i)
+		}
+	}
+
+	if n := atomic.LoadInt64(&stops); n != conns {
+		t.Fatalf("OnConnStop called %d times, expected %d", n, conns)
+	}
+	if n := s.ConnMgr.Len(); n != 0 {
+		t.Fatalf("expected all connections removed, %d left", n)
+	}
+}
+
+func TestConnCloseReason(t *testing.T) {
+	tests := []struct {
+		name  string
+		close func(s *Server, client net.Conn, conn iface.IConnection)
+		code  iface.CloseCode
+		err   error
+	}{
+		{"eof", func(s *Server, client net.Conn, conn iface.IConnection) {
+			client.Close()
+		}, iface.CloseEOF, nil},
+		{"protocol", func(s *Server, client net.Conn, conn iface.IConnection) {
+			head := make([]byte, NewDataPack().GetHeadLen())
+			binary.LittleEndian.PutUint32(head, 1<<30)
+			client.Write(head)
+		}, iface.CloseProtocolError, ErrPacketTooLarge},
+		{"kicked", func(s *Server, client net.Conn, conn iface.IConnection) {
+			conn.Stop()
+		}, iface.CloseKicked, nil},
+		{"shutdown", func(s *Server, client net.Conn, conn iface.IConnection) {
+			s.Stop()
+		}, iface.CloseServerShutdown, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer()
+			s.SetDataPack(&DataPack{MaxPacketSize: 16})
+			reasons := make(chan iface.CloseReason, 2)
+			s.SetOnConnClosed(func(conn iface.IConnection, reason iface.CloseReason) {
+				if conn.CloseReason() != reason {
+					t.Errorf("hook reason %v differs from conn.CloseReason() %v", reason, conn.CloseReason())
+				}
+				reasons <- reason
+			})
+			if err := s.Start(); err != nil {
+				t.Fatal(err)
+			}
+			defer s.Stop()
+
+			client, conn := dialTestConn(t, s)
+			defer client.Close()
+			if code := conn.CloseReason().Code; code != iface.CloseNone {
+				t.Fatalf("expected CloseNone before close, got %s", code)
+			}
+			tt.close(s, client, conn)
+
+			select {
+			case reason := <-reasons:
+				if reason.Code != tt.code {
+					t.Fatalf("expected %s, got %s", tt.code, reason)
+				}
+				if (tt.err == nil) != (reason.Err == nil) || tt.err != nil && !errors.Is(reason.Err, tt.err) {
+					t.Fatalf("expected err %v, got %v", tt.err, reason.Err)
+				}
+				if reason.Err != conn.GetCloseErr() {
+					t.Fatalf("GetCloseErr %v differs from reason err %v", conn.GetCloseErr(), reason.Err)
+				}
+			case <-time.After(3 * time.Second):
+				t.Fatal("connection was not closed")
+			}
+		})
+	}
+}
@@ -0,0 +1,52 @@
+package impl
+
+import (
+	"sync/atomic"
+)
+
+//AtomicConnIDGenerator 默认的连接ID生成器，从0开始原子递增，回绕后跳过仍被存活连接使用的ID
+type AtomicConnIDGenerator struct {
+	next uint32
+}
+
+//NextID 生成下一个连接ID
+func (g *AtomicConnIDGenerator) NextID(inUse func(connID uint32) bool) uint32 {
+	for {
+		id := atomic.AddUint32(&g.next, 1) - 1
+		if inUse == nil || !inUse(id) {
+			return id
+		}
+	}
+}
+
+//nodeCounterBits 节点连接ID中计数部分的位数
+const nodeCounterBits = 24
+
+//NodeConnIDGenerator 集群中全局唯一的连接ID生成器，高8位为节点编号，低24位为原子递增的计数
+type NodeConnIDGenerator struct {
+	node    uint32
+	counter uint32
+}
+
+//NewNodeConnIDGenerator 创建节点连接ID生成器，集群中每个节点应使用不同的nodeID
+func NewNodeConnIDGenerator(nodeID uint8) *NodeConnIDGenerator {
+	return &NodeConnIDGenerator{
+		node: uint32(nodeID) << nodeCounterBits,
+	}
+}
+
+//NextID 生成下一个连接ID，计数部分回绕后跳过仍被存活连接使用的ID
+func (g *NodeConnIDGenerator) NextID(inUse func(connID uint32) bool) uint32 {
+	for {
+		n := atomic.AddUint32(&g.counter, 1) - 1
+		id := g.node | n&(1<<nodeCounterBits-1)
+		if inUse == nil || !inUse(id) {
+			return id
+		}
+	}
+}
+
+//NodeOf 获取连接ID所属的节点编号
+func NodeOf(connID uint32) uint8 {
+	return uint8(connID >> nodeCounterBits)
+}
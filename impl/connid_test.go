@@ -0,0 +1,84 @@
+package impl
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestConnIDSkipsLiveIDs(t *testing.T) {
+	live := map[uint32]bool{1: true, 2: true}
+	inUse := func(id uint32) bool { return live[id] }
+
+	g := &AtomicConnIDGenerator{}
+	for _, want := range []uint32{0, 3, 4} {
+		if id := g.NextID(inUse); id != want {
+			t.Fatalf("expected %d, got %d", want, id)
+		}
+	}
+
+	//回绕后同样跳过仍存活的ID
+	g = &AtomicConnIDGenerator{next: ^uint32(0)}
+	live = map[uint32]bool{0: true}
+	if id := g.NextID(inUse); id != ^uint32(0) {
+		t.Fatalf("unexpected id %d", id)
+	}
+	if id := g.NextID(inUse); id != 1 {
+		t.Fatalf("expected wrapped id to skip live id 0, got %d", id)
+	}
+}
+
+func TestConnIDConcurrentUnique(t *testing.T) {
+	g := &AtomicConnIDGenerator{}
+	const workers, each = 8, 1000
+	ids := make(chan uint32, workers*each)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < each; j++ {
+				ids <- g.NextID(nil)
+			}
+		}()
+	}
+	wg.Wait()
+	close(ids)
+
+	seen := make(map[uint32]bool)
+	for id := range ids {
+		if seen[id] {
+			t.Fatalf("duplicate id %d", id)
+		}
+		seen[id] = true
+	}
+}
+
+func TestConnIDNodePrefix(t *testing.T) {
+	g := NewNodeConnIDGenerator(3)
+	id := g.NextID(nil)
+	if NodeOf(id) != 3 || id != 3<<nodeCounterBits {
+		t.Fatalf("unexpected node id %x", id)
+	}
+
+	//计数部分回绕时不影响节点编号，并跳过仍存活的ID
+	g.counter = 1<<nodeCounterBits - 1
+	last := g.NextID(nil)
+	wrapped := g.NextID(func(connID uint32) bool { return connID == id })
+	if NodeOf(last) != 3 || NodeOf(wrapped) != 3 || wrapped != id+1 {
+		t.Fatalf("unexpected ids after wrap %x %x", last, wrapped)
+	}
+}
+
+func TestConnIDServerGenerator(t *testing.T) {
+	s := NewServer(WithAddr("127.0.0.1", 0), WithConnIDGenerator(NewNodeConnIDGenerator(7))).(*Server)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	client, conn := dialTestConn(t, s)
+	defer client.Close()
+	if NodeOf(conn.GetConnID()) != 7 {
+		t.Fatalf("unexpected conn id %x", conn.GetConnID())
+	}
+}
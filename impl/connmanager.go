@@ -14,14 +14,21 @@ import (
 type ConnManager struct {
 	connections map[uint32]iface.IConnection //管理的连接信息
 	connLock    sync.RWMutex                 //读写连接的读写锁
+	cfg         *utils.GlobalObj             //所属Server的配置
 }
 
 /*
 	创建一个链接管理
 */
 func NewConnManager() *ConnManager {
+	return newConnManager(utils.GlobalObject)
+}
+
+//newConnManager 使用指定配置创建一个链接管理
+func newConnManager(cfg *utils.GlobalObj) *ConnManager {
 	return &ConnManager{
 		connections: make(map[uint32]iface.IConnection),
+		cfg:         cfg,
 	}
 }
 
@@ -34,7 +41,7 @@ func (connMgr *ConnManager) Add(conn iface.IConnection) {
 	//将conn连接添加到ConnMananger中
 	connMgr.connections[conn.GetConnID()] = conn
 
-	utils.GlobalObject.Logger.Info("connection 添加到tcp连接管理池成功: conn count = ", connMgr.Len())
+	connMgr.cfg.Logger.Info("connection 添加到tcp连接管理池成功: conn count = ", len(connMgr.connections))
 }
 
 //删除连接
@@ -46,7 +53,7 @@ func (connMgr *ConnManager) Remove(conn iface.IConnection) {
 	//删除连接信息
 	delete(connMgr.connections, conn.GetConnID())
 
-	utils.GlobalObject.Logger.Info("connection 从tcp连接管理池移除成功 ConnID=", conn.GetConnID(), ": conn count = ", connMgr.Len())
+	connMgr.cfg.Logger.Info("connection 从tcp连接管理池移除成功 ConnID=", conn.GetConnID(), ": conn count = ", len(connMgr.connections))
 }
 
 //利用ConnID获取链接
@@ -64,29 +71,38 @@ func (connMgr *ConnManager) Get(connID uint32) (iface.IConnection, error) {
 
 //获取当前连接
 func (connMgr *ConnManager) Len() int {
+	connMgr.connLock.RLock()
+	defer connMgr.connLock.RUnlock()
+
 	return len(connMgr.connections)
 }
 
 //清除并停止所有连接
 func (connMgr *ConnManager) ClearConn() {
-	// 此处加写锁会导致死锁
-	// connMgr.connLock.Lock()
-	// defer connMgr.connLock.Unlock()
-
+	// 此处加写锁会导致死锁(Stop内部会调用Remove)，因此在快照上遍历
 	//停止并删除全部的连接信息
-	for connID, conn := range connMgr.connections {
+	for connID, conn := range connMgr.GetAll() {
 		//停止
 		conn.Stop()
 		//删除
+		connMgr.connLock.Lock()
 		delete(connMgr.connections, connID)
+		connMgr.connLock.Unlock()
 	}
 
-	utils.GlobalObject.Logger.Info("Clear All Connections successfully: conn count = ", connMgr.Len())
+	connMgr.cfg.Logger.Info("Clear All Connections successfully: conn count = ", connMgr.Len())
 }
 
-//GetAll 获取当前所有连接
+//GetAll 获取当前所有连接的快照，遍历时不受连接增删影响
 func (connMgr *ConnManager) GetAll() map[uint32]iface.IConnection {
-	return connMgr.connections
+	connMgr.connLock.RLock()
+	defer connMgr.connLock.RUnlock()
+
+	conns := make(map[uint32]iface.IConnection, len(connMgr.connections))
+	for connID, conn := range connMgr.connections {
+		conns[connID] = conn
+	}
+	return conns
 }
 
 //GetConnByProp 根据属性获取所有连接
@@ -3,16 +3,40 @@ package impl
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
 
 	"github.com/ajdwfnhaps/easy-tcp-server/iface"
+	"github.com/ajdwfnhaps/easy-tcp-server/utils"
 )
 
-//DataPack 封包拆包类实例，暂时不需要成员
-type DataPack struct{}
+var (
+	//ErrPacketTooLarge 包体长度超过MaxPacketSize
+	ErrPacketTooLarge = errors.New("packet body size exceeds max packet size")
+	//ErrBadHeader 包头非法，如包体长度为负数、版本号未知或包长度与包头不符
+	ErrBadHeader = errors.New("bad packet header")
+)
+
+//DataPack 封包拆包类实例
+type DataPack struct {
+	//包体的最大长度，为0时不限制
+	MaxPacketSize uint32
+	//允许的协议版本号，为空时不校验
+	Versions [][4]byte
+}
 
-//NewDataPack 封包拆包实例初始化方法
+//NewDataPack 封包拆包实例初始化方法，包体最大长度取自GlobalObject.MaxPacketSize
 func NewDataPack() *DataPack {
-	return &DataPack{}
+	return newDataPack(utils.GlobalObject.MaxPacketSize)
+}
+
+//newDataPack 创建包体最大长度为maxPacketSize的封包拆包实例
+func newDataPack(maxPacketSize uint32) *DataPack {
+	return &DataPack{
+		MaxPacketSize: maxPacketSize,
+		Versions:      [][4]byte{DefaultVersion},
+	}
 }
 
 //GetHeadLen 获取包头长度方法
@@ -20,6 +44,40 @@ func (dp *DataPack) GetHeadLen() uint32 {
 	return 24
 }
 
+//GetPkgLen 根据包头计算完整包的长度(包头+包体)，包头前4字节为小端序的包体长度，随后4字节为版本号
+func (dp *DataPack) GetPkgLen(head []byte) (uint32, error) {
+	if uint32(len(head)) < dp.GetHeadLen() {
+		return 0, ErrBadHeader
+	}
+
+	bodySize := int32(binary.LittleEndian.Uint32(head[0:4]))
+	var version [4]byte
+	copy(version[:], head[4:8])
+	if err := dp.checkHead(bodySize, version); err != nil {
+		return 0, err
+	}
+	return dp.GetHeadLen() + uint32(bodySize), nil
+}
+
+//checkHead 校验包体长度及版本号
+func (dp *DataPack) checkHead(bodySize int32, version [4]byte) error {
+	if bodySize < 0 {
+		return fmt.Errorf("%w: negative body size %d", ErrBadHeader, bodySize)
+	}
+	if dp.MaxPacketSize > 0 && uint32(bodySize) > dp.MaxPacketSize {
+		return fmt.Errorf("%w: body size %d > %d", ErrPacketTooLarge, bodySize, dp.MaxPacketSize)
+	}
+	if len(dp.Versions) == 0 {
+		return nil
+	}
+	for _, v := range dp.Versions {
+		if v == version {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: unknown version %q", ErrBadHeader, version[:])
+}
+
 //Pack 封包方法(压缩数据)
 func (dp *DataPack) Pack(msg iface.IMessage) ([]byte, error) {
 	//创建一个存放bytes字节的缓冲
@@ -41,19 +99,68 @@ func (dp *DataPack) Unpack(binaryData []byte) (iface.IMessage, error) {
 	//创建一个从输入二进制数据的ioReader
 	dataBuff := bytes.NewReader(binaryData)
 
-	//只解压head的信息，得到dataLen和msgID
+	if uint32(len(binaryData)) < dp.GetHeadLen() {
+		return nil, ErrBadHeader
+	}
+
+	//先解压head的信息，校验通过后再读取包体
 	msg := &Message{}
 
-	var err error
-	err = binary.Read(dataBuff, binary.LittleEndian, &msg.BodySize)
-	err = binary.Read(dataBuff, binary.BigEndian, &msg.Version)
-	err = binary.Read(dataBuff, binary.BigEndian, &msg.Compress)
-	err = binary.Read(dataBuff, binary.BigEndian, &msg.ClientType)
+	binary.Read(dataBuff, binary.LittleEndian, &msg.BodySize)
+	binary.Read(dataBuff, binary.BigEndian, &msg.Version)
+	binary.Read(dataBuff, binary.BigEndian, &msg.Compress)
+	binary.Read(dataBuff, binary.BigEndian, &msg.ClientType)
+	binary.Read(dataBuff, binary.BigEndian, &msg.BsdCode)
 
-	err = binary.Read(dataBuff, binary.BigEndian, &msg.BsdCode)
+	if err := dp.checkHead(msg.BodySize, msg.Version); err != nil {
+		return nil, err
+	}
+	if dataBuff.Len() < int(msg.BodySize) {
+		return nil, fmt.Errorf("%w: body size %d, but only %d bytes", ErrBadHeader, msg.BodySize, dataBuff.Len())
+	}
 
 	msg.Body = make([]byte, msg.BodySize)
-	err = binary.Read(dataBuff, binary.BigEndian, &msg.Body)
+	if _, err := io.ReadFull(dataBuff, msg.Body); err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+//Decode 从r中读取并拆出一个完整的消息包，阻塞直到读满整个包或出错。
+//r应为每个连接持有的同一个带缓冲的Reader，包跨越多个TCP分段或多个包粘连时都能正确拆分
+func (dp *DataPack) Decode(r io.Reader) (iface.IMessage, error) {
+	data, err := ReadPkg(r, dp)
+	if err != nil {
+		return nil, err
+	}
+	return dp.Unpack(data)
+}
+
+//ReadPkg 按dp的包头格式从r中读取一个完整包的原始字节(包头+包体+包尾)，供IDataPack实现Decode时复用。
+//连接在包的边界处正常关闭时返回io.EOF，在包中途关闭时返回io.ErrUnexpectedEOF
+func ReadPkg(r io.Reader, dp iface.IDataPack) ([]byte, error) {
+	headLen := dp.GetHeadLen()
+	head := make([]byte, headLen)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, err
+	}
+
+	pkgLength, err := dp.GetPkgLen(head)
+	if err != nil {
+		return nil, err
+	}
+	if pkgLength < headLen {
+		return nil, io.ErrUnexpectedEOF
+	}
 
-	return msg, err
+	data := make([]byte, pkgLength)
+	copy(data, head)
+	if _, err := io.ReadFull(r, data[headLen:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return data, nil
 }
@@ -0,0 +1,98 @@
+package impl
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+	"testing/iotest"
+)
+
+func packTestMsgs(t *testing.T, bodies ...string) []byte {
+	dp := NewDataPack()
+	var buf bytes.Buffer
+	for _, body := range bodies {
+		data, err := dp.Pack(NewMsgPackage([]byte(body)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf.Write(data)
+	}
+	return buf.Bytes()
+}
+
+func TestDataPackDecodeByteByByte(t *testing.T) {
+	bodies := []string{`{"cmd":"request_heartbeat","seqno":"1"}`, `{"cmd":"request_mid","seqno":"2"}`}
+	reader := bufio.NewReader(iotest.OneByteReader(bytes.NewReader(packTestMsgs(t, bodies...))))
+
+	dp := NewDataPack()
+	for _, body := range bodies {
+		msg, err := dp.Decode(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(msg.GetBody()) != body {
+			t.Fatalf("expected %s, got %s", body, msg.GetBody())
+		}
+	}
+	if _, err := dp.Decode(reader); err != io.EOF {
+		t.Fatalf("expected io.EOF, got %v", err)
+	}
+}
+
+func TestDataPackDecodeCoalesced(t *testing.T) {
+	bodies := []string{"a", "", "bb", "ccc"}
+	reader := bufio.NewReader(bytes.NewReader(packTestMsgs(t, bodies...)))
+
+	dp := NewDataPack()
+	for _, body := range bodies {
+		msg, err := dp.Decode(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(msg.GetBody()) != body {
+			t.Fatalf("expected %q, got %q", body, msg.GetBody())
+		}
+	}
+}
+
+func TestDataPackDecodeTruncated(t *testing.T) {
+	data := packTestMsgs(t, "truncated")
+	for _, n := range []int{1, int(NewDataPack().GetHeadLen()), len(data) - 1} {
+		_, err := NewDataPack().Decode(bytes.NewReader(data[:n]))
+		if err != io.ErrUnexpectedEOF {
+			t.Fatalf("cut at %d: expected io.ErrUnexpectedEOF, got %v", n, err)
+		}
+	}
+}
+
+func TestDataPackRejectsBadHeader(t *testing.T) {
+	dp := NewDataPack()
+	dp.MaxPacketSize = 16
+
+	tooLarge := packTestMsgs(t, "this body is longer than sixteen bytes")
+	negative := packTestMsgs(t, "x")
+	binary.LittleEndian.PutUint32(negative[0:4], 0xFFFFFFFF)
+	badVersion := packTestMsgs(t, "x")
+	copy(badVersion[4:8], "9999")
+
+	cases := []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{"too large", tooLarge, ErrPacketTooLarge},
+		{"negative size", negative, ErrBadHeader},
+		{"unknown version", badVersion, ErrBadHeader},
+	}
+	for _, c := range cases {
+		if _, err := dp.Unpack(c.data); !errors.Is(err, c.want) {
+			t.Errorf("%s: Unpack expected %v, got %v", c.name, c.want, err)
+		}
+		if _, err := dp.Decode(bytes.NewReader(c.data)); !errors.Is(err, c.want) {
+			t.Errorf("%s: Decode expected %v, got %v", c.name, c.want, err)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package impl
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/ajdwfnhaps/easy-tcp-server/dto"
+	"github.com/ajdwfnhaps/easy-tcp-server/iface"
+)
+
+//ErrIdleTimeout 连接在ReadIdleTimeout内未收到客户端任何数据，因空闲被关闭
+var ErrIdleTimeout = errors.New("idle")
+
+//reasonStopper 可携带关闭原因停止的连接
+type reasonStopper interface {
+	stopWithReason(code iface.CloseCode, err error)
+}
+
+//HeartbeatCmd 服务端默认心跳消息的cmd
+const HeartbeatCmd = "request_heartbeat"
+
+//DefaultHeartbeatMsg 服务端默认的心跳消息
+func DefaultHeartbeatMsg(conn iface.IConnection) []byte {
+	data, _ := json.Marshal(dto.Result{
+		Cmd: HeartbeatCmd,
+	})
+	return data
+}
+
+//heartbeatCheckInterval 心跳检测的间隔：取心跳间隔与读空闲超时一半中较小的非零值
+func (s *Server) heartbeatCheckInterval() time.Duration {
+	interval := s.HeartbeatInterval
+	if s.ReadIdleTimeout > 0 && (interval <= 0 || s.ReadIdleTimeout/2 < interval) {
+		interval = s.ReadIdleTimeout / 2
+	}
+	return interval
+}
+
+//startHeartbeat 心跳检测Goroutine，定期关闭空闲连接，并向一段时间未活跃的连接发送心跳，服务关闭时退出
+func (s *Server) startHeartbeat() {
+	interval := s.heartbeatCheckInterval()
+	if interval <= 0 {
+		return
+	}
+	s.Logger.Info("心跳检测已启动, interval = ", interval)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			s.checkHeartbeat(now)
+		case <-s.doneChan:
+			s.Logger.Debug("心跳检测已退出")
+			return
+		}
+	}
+}
+
+//checkHeartbeat 检查所有连接的最后活跃时间
+func (s *Server) checkHeartbeat(now time.Time) {
+	for _, conn := range s.ConnMgr.GetAll() {
+		idle := now.Sub(conn.GetLastActivity())
+
+		//1 超过读空闲超时未收到数据，关闭连接
+		if s.ReadIdleTimeout > 0 && idle >= s.ReadIdleTimeout {
+			s.Logger.Warnf("客户端[%s]已空闲%s，超过读空闲超时%s，将会关闭连接", conn.RemoteAddr(), idle, s.ReadIdleTimeout)
+			if c, ok := conn.(reasonStopper); ok {
+				c.stopWithReason(iface.CloseIdleTimeout, ErrIdleTimeout)
+			} else {
+				conn.Stop()
+			}
+			continue
+		}
+
+		//2 超过心跳间隔未收到数据，向客户端发送心跳
+		if s.HeartbeatInterval > 0 && idle >= s.HeartbeatInterval && s.HeartbeatMsgFunc != nil {
+			if err := conn.SendBuffMsg(s.HeartbeatMsgFunc(conn)); err != nil {
+				s.Logger.Errorf("向客户端[%s]发送心跳报错:%s", conn.RemoteAddr(), err.Error())
+			}
+		}
+	}
+}
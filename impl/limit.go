@@ -0,0 +1,211 @@
+package impl
+
+import (
+	"errors"
+	"math"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/ajdwfnhaps/easy-tcp-server/utils"
+)
+
+var (
+	//ErrMaxConn 连接数已达到全局上限max_conn
+	ErrMaxConn = errors.New("max conn exceeded")
+	//ErrListenerMaxConn 连接数已达到监听器的上限
+	ErrListenerMaxConn = errors.New("listener max conn exceeded")
+	//ErrMaxConnPerIP 同一客户端IP的连接数已达到上限max_conn_per_ip
+	ErrMaxConnPerIP = errors.New("max conn per ip exceeded")
+	//ErrAcceptRate 接入连接的速率超过accept_rate
+	ErrAcceptRate = errors.New("accept rate exceeded")
+	//ErrAcceptRatePerIP 同一客户端IP接入连接的速率超过accept_rate_per_ip
+	ErrAcceptRatePerIP = errors.New("accept rate per ip exceeded")
+)
+
+//limiterSweepInterval 清理空闲客户端IP记录的间隔
+const limiterSweepInterval = time.Minute
+
+//connAdmitter 按客户端IP限制连接，经过PROXY协议代理的连接在读取头部后按真实的客户端地址限制
+type connAdmitter interface {
+	admitIP(addr net.Addr) (release func(), err error)
+}
+
+//tokenBucket 令牌桶，每秒补充rate个令牌，最多存放burst个令牌
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int, now time.Time) *tokenBucket {
+	b := float64(burst)
+	if b < 1 {
+		b = math.Max(1, math.Ceil(rate))
+	}
+	return &tokenBucket{
+		rate:   rate,
+		burst:  b,
+		tokens: b,
+		last:   now,
+	}
+}
+
+//refill 按流逝的时间补充令牌
+func (b *tokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(b.burst, b.tokens+elapsed*b.rate)
+	}
+	b.last = now
+}
+
+//allow 取出一个令牌，没有令牌时返回false
+func (b *tokenBucket) allow(now time.Time) bool {
+	b.refill(now)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+//ipState 一个客户端IP的连接数及接入速率
+type ipState struct {
+	conns  int
+	bucket *tokenBucket
+}
+
+//connLimiter 接入连接的速率及每个客户端IP的连接数限制
+type connLimiter struct {
+	maxPerIP   int
+	ratePerIP  float64
+	burstPerIP int
+	//全局接入速率，nil为不限制
+	bucket *tokenBucket
+
+	lock      sync.Mutex
+	ips       map[string]*ipState
+	lastSweep time.Time
+}
+
+//newConnLimiter 根据配置创建连接限制，未配置任何限制时返回nil
+func newConnLimiter(cfg *utils.GlobalObj) *connLimiter {
+	if cfg.MaxConnPerIP <= 0 && cfg.AcceptRate <= 0 && cfg.AcceptRatePerIP <= 0 {
+		return nil
+	}
+	now := time.Now()
+	l := &connLimiter{
+		maxPerIP:   cfg.MaxConnPerIP,
+		ratePerIP:  cfg.AcceptRatePerIP,
+		burstPerIP: cfg.AcceptBurstPerIP,
+		ips:        make(map[string]*ipState),
+		lastSweep:  now,
+	}
+	if cfg.AcceptRate > 0 {
+		l.bucket = newTokenBucket(cfg.AcceptRate, cfg.AcceptBurst, now)
+	}
+	return l
+}
+
+//allowAccept 检查全局接入速率
+func (l *connLimiter) allowAccept() error {
+	if l.bucket == nil {
+		return nil
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if !l.bucket.allow(time.Now()) {
+		return ErrAcceptRate
+	}
+	return nil
+}
+
+//acquire 检查并占用客户端IP的连接数及接入速率，成功时返回释放该连接的方法
+func (l *connLimiter) acquire(ip string) (func(), error) {
+	if l.maxPerIP <= 0 && l.ratePerIP <= 0 {
+		return nil, nil
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := time.Now()
+	l.sweep(now)
+
+	state, ok := l.ips[ip]
+	if !ok {
+		state = &ipState{}
+		if l.ratePerIP > 0 {
+			state.bucket = newTokenBucket(l.ratePerIP, l.burstPerIP, now)
+		}
+		l.ips[ip] = state
+	}
+
+	if l.maxPerIP > 0 && state.conns >= l.maxPerIP {
+		return nil, ErrMaxConnPerIP
+	}
+	if state.bucket != nil && !state.bucket.allow(now) {
+		return nil, ErrAcceptRatePerIP
+	}
+	state.conns++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.lock.Lock()
+			state.conns--
+			l.lock.Unlock()
+		})
+	}, nil
+}
+
+//sweep 定期删除没有连接且令牌已补满的客户端IP记录，避免记录无限增长
+func (l *connLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < limiterSweepInterval {
+		return
+	}
+	l.lastSweep = now
+	for ip, state := range l.ips {
+		if state.conns > 0 {
+			continue
+		}
+		if state.bucket != nil {
+			state.bucket.refill(now)
+			if state.bucket.tokens < state.bucket.burst {
+				continue
+			}
+		}
+		delete(l.ips, ip)
+	}
+}
+
+//admit 在创建连接之前检查连接数及接入速率限制，未通过时返回拒绝的原因
+func (s *Server) admit(conn net.Conn, l *listener) error {
+	if s.ConnMgr.Len() >= s.cfg.MaxConn {
+		return ErrMaxConn
+	}
+	if l.maxConn > 0 && l.ConnCount() >= l.maxConn {
+		return ErrListenerMaxConn
+	}
+	if s.limiter != nil {
+		return s.limiter.allowAccept()
+	}
+	return nil
+}
+
+//admitIP 检查客户端IP的连接数及接入速率限制，非IP地址(如Unix socket)的连接不受限制
+func (s *Server) admitIP(addr net.Addr) (func(), error) {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if s.limiter == nil || !ok {
+		return nil, nil
+	}
+	return s.limiter.acquire(tcpAddr.IP.String())
+}
+
+//rejectConn 拒绝接入连接并调用OnConnRejected Hook函数
+func (s *Server) rejectConn(conn net.Conn, reason error) {
+	s.Logger.Warnf("拒绝客户端[%s]的连接: %s", conn.RemoteAddr(), reason)
+	conn.Close()
+	s.CallOnConnRejected(conn.RemoteAddr(), reason)
+}
@@ -0,0 +1,271 @@
+package impl
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ajdwfnhaps/easy-tcp-server/iface"
+	"github.com/ajdwfnhaps/easy-tcp-server/utils"
+)
+
+type rejection struct {
+	addr   net.Addr
+	reason error
+}
+
+//startLimitTestServer 启动测试Server，返回拒绝连接时的记录，started不为nil时在连接创建时通知
+func startLimitTestServer(t *testing.T, started chan struct{}, opts ...Option) (*Server, chan rejection) {
+	opts = append([]Option{WithAddr("127.0.0.1", 0)}, opts...)
+	s := NewServer(opts...).(*Server)
+	s.AddRouter("request_echo", &echoRouter{})
+	rejected := make(chan rejection, 8)
+	s.SetOnConnRejected(func(addr net.Addr, reason error) {
+		rejected <- rejection{addr, reason}
+	})
+	if started != nil {
+		s.SetOnConnStart(func(conn iface.IConnection) {
+			started <- struct{}{}
+		})
+	}
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return s, rejected
+}
+
+//expectRejected 连接应被关闭，且OnConnRejected收到reason
+func expectRejected(t *testing.T, client net.Conn, rejected chan rejection, reason error) {
+	client.SetDeadline(time.Now().Add(3 * time.Second))
+	if _, err := client.Read(make([]byte, 1)); err == nil {
+		t.Fatal("rejected conn should be closed")
+	}
+	select {
+	case r := <-rejected:
+		if !errors.Is(r.reason, reason) {
+			t.Fatalf("expected %v, got %v", reason, r.reason)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("OnConnRejected not called")
+	}
+}
+
+func TestLimitTokenBucket(t *testing.T) {
+	now := time.Now()
+	b := newTokenBucket(2, 3, now)
+	for i := 0; i < 3; i++ {
+		if !b.allow(now) {
+			t.Fatalf("burst token %d should be allowed", i)
+		}
+	}
+	if b.allow(now) {
+		t.Fatal("bucket should be empty")
+	}
+	if !b.allow(now.Add(500 * time.Millisecond)) {
+		t.Fatal("one token should be refilled after 500ms")
+	}
+	if b.allow(now.Add(500 * time.Millisecond)) {
+		t.Fatal("bucket should be empty again")
+	}
+	if !newTokenBucket(0.5, 0, now).allow(now) {
+		t.Fatal("burst should default to at least one token")
+	}
+}
+
+func TestLimitMaxConnPerIP(t *testing.T) {
+	started := make(chan struct{}, 4)
+	s, rejected := startLimitTestServer(t, started, WithMaxConnPerIP(1))
+	defer s.Stop()
+
+	first, _ := dialTestConn(t, s)
+	<-started
+
+	second, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	expectRejected(t, second, rejected, ErrMaxConnPerIP)
+	select {
+	case <-started:
+		t.Fatal("rejected conn must not be started")
+	default:
+	}
+	if s.ConnMgr.Len() != 1 {
+		t.Fatalf("rejected conn must not be added, got %d", s.ConnMgr.Len())
+	}
+
+	//连接关闭后释放客户端IP的连接数
+	first.Close()
+	for i := 0; s.ConnMgr.Len() != 0; i++ {
+		if i > 300 {
+			t.Fatal("conn not removed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	echoOver(t, s, "tcp", s.Addr().String())
+}
+
+func TestLimitAcceptRate(t *testing.T) {
+	s, rejected := startLimitTestServer(t, nil, WithAcceptRate(0.001, 2))
+	defer s.Stop()
+
+	for i := 0; i < 2; i++ {
+		client, _ := dialTestConn(t, s)
+		defer client.Close()
+	}
+	client, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	expectRejected(t, client, rejected, ErrAcceptRate)
+}
+
+func TestLimitAcceptRatePerIP(t *testing.T) {
+	cfg := utils.NewConfig()
+	cfg.Host = "127.0.0.1"
+	cfg.TcpPort = 0
+	cfg.AcceptRatePerIP = 0.001
+	cfg.AcceptBurstPerIP = 1
+	s := NewServerWithConfig(cfg).(*Server)
+	rejected := make(chan rejection, 1)
+	s.SetOnConnRejected(func(addr net.Addr, reason error) {
+		rejected <- rejection{addr, reason}
+	})
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	first, _ := dialTestConn(t, s)
+	first.Close()
+
+	//连接关闭后速率限制仍然生效
+	client, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	expectRejected(t, client, rejected, ErrAcceptRatePerIP)
+}
+
+func TestLimitPerIPBehindProxy(t *testing.T) {
+	s := NewServer(WithAddr("127.0.0.1", 0), WithProxyProtocol(), WithMaxConnPerIP(1)).(*Server)
+	s.AddRouter("request_echo", &echoRouter{})
+	rejected := make(chan rejection, 1)
+	s.SetOnConnRejected(func(addr net.Addr, reason error) {
+		rejected <- rejection{addr, reason}
+	})
+	//被拒绝的连接只调用OnConnRejected，与未经代理的连接一致
+	var stops int64
+	s.SetOnConnClosed(func(conn iface.IConnection, reason iface.CloseReason) {
+		atomic.AddInt64(&stops, 1)
+	})
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	//按PROXY协议头部中真实的客户端IP限制，而不是代理的地址
+	first := dialWithHeader(t, s, []byte("PROXY TCP4 203.0.113.7 10.0.0.1 50001 8091\r\n"))
+	defer first.Close()
+	expectEcho(t, s, first)
+
+	other := dialWithHeader(t, s, []byte("PROXY TCP4 203.0.113.8 10.0.0.1 50002 8091\r\n"))
+	defer other.Close()
+	expectEcho(t, s, other)
+
+	second := dialWithHeader(t, s, []byte("PROXY TCP4 203.0.113.7 10.0.0.1 50003 8091\r\n"))
+	defer second.Close()
+	expectRejected(t, second, rejected, ErrMaxConnPerIP)
+	for i := 0; s.ConnMgr.Len() != 2; i++ {
+		if i > 300 {
+			t.Fatal("rejected conn not removed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := atomic.LoadInt64(&stops); n != 0 {
+		t.Fatalf("stop hooks called %d times for a rejected conn", n)
+	}
+}
+
+func TestLimitSweepIdleIPs(t *testing.T) {
+	cfg := utils.NewConfig()
+	cfg.MaxConnPerIP = 1
+	cfg.AcceptRatePerIP = 10
+	l := newConnLimiter(cfg)
+
+	release, err := l.acquire("203.0.113.7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.acquire("203.0.113.8"); err != nil {
+		t.Fatal(err)
+	}
+	release()
+	release()
+
+	//没有连接且令牌已补满的记录被清理，仍有连接的记录保留
+	l.lock.Lock()
+	l.lastSweep = time.Now().Add(-limiterSweepInterval)
+	l.sweep(time.Now().Add(time.Second))
+	_, idle := l.ips["203.0.113.7"]
+	_, live := l.ips["203.0.113.8"]
+	l.lock.Unlock()
+	if idle || !live {
+		t.Fatalf("unexpected ip records idle=%v live=%v", idle, live)
+	}
+}
+
+func TestLimitReleaseOnEarlyStop(t *testing.T) {
+	s, _ := startLimitTestServer(t, nil, WithMaxConnPerIP(1))
+	defer s.Stop()
+
+	//连接刚加入链接管理即被关闭，仍需释放客户端IP的连接数
+	stop := make(chan struct{})
+	cleared := make(chan struct{})
+	go func() {
+		defer close(cleared)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				s.ConnMgr.ClearConn()
+			}
+		}
+	}()
+	for i := 0; i < 30; i++ {
+		client, err := net.Dial("tcp", s.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.SetDeadline(time.Now().Add(3 * time.Second))
+		client.Read(make([]byte, 1))
+		client.Close()
+	}
+	close(stop)
+	<-cleared
+
+	for i := 0; ; i++ {
+		s.limiter.lock.Lock()
+		conns := 0
+		for _, state := range s.limiter.ips {
+			conns += state.conns
+		}
+		s.limiter.lock.Unlock()
+		if conns == 0 {
+			break
+		}
+		if i > 300 {
+			t.Fatalf("%d per-ip slots leaked", conns)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := s.Listeners()[0].ConnCount(); n != 0 {
+		t.Fatalf("listener conn count drifted to %d", n)
+	}
+}
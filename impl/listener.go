@@ -0,0 +1,182 @@
+package impl
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/ajdwfnhaps/easy-tcp-server/utils"
+)
+
+//NetworkUnix 监听Unix socket的网络类型
+const NetworkUnix = "unix"
+
+//DefaultIPVersion 未配置ip_version时监听的网络类型，保持只监听IPv4
+const DefaultIPVersion = "tcp4"
+
+//DefaultListenerName Server自身地址对应的监听器名称
+const DefaultListenerName = "default"
+
+//ErrSocketInUse Unix socket文件仍有其他进程在监听
+var ErrSocketInUse = errors.New("unix socket already in use")
+
+//listener 服务的一个监听器，同一Server的所有监听器共享路由、连接管理及广播
+type listener struct {
+	conns         int64 //当前监听器接入的连接数，原子操作，放在首位保证64位对齐
+	name          string
+	maxConn       int
+	tlsConfig     *tls.Config
+	proxyProtocol bool //是否解析PROXY协议头部
+	ln            net.Listener
+}
+
+//Name 获取监听器名称
+func (l *listener) Name() string {
+	return l.name
+}
+
+//Addr 获取监听器实际监听的地址
+func (l *listener) Addr() net.Addr {
+	return l.ln.Addr()
+}
+
+//ConnCount 获取当前监听器接入的连接数
+func (l *listener) ConnCount() int {
+	return int(atomic.LoadInt64(&l.conns))
+}
+
+//listenDefault 监听Server自身的地址
+func (s *Server) listenDefault() (*listener, error) {
+	//IPv6地址需要加上方括号，如[::1]:8091
+	network, address := s.IPVersion, net.JoinHostPort(strings.Trim(s.IP, "[]"), strconv.Itoa(s.Port))
+	if s.Network == NetworkUnix {
+		network, address = NetworkUnix, s.Address
+		if s.UnixSocketMode == 0 {
+			mode, err := parseSocketMode(s.cfg.UnixSocketMode)
+			if err != nil {
+				return nil, err
+			}
+			s.UnixSocketMode = mode
+		}
+	}
+
+	ln, err := listen(network, address, s.UnixSocketMode)
+	if err != nil {
+		return nil, err
+	}
+	return &listener{
+		name:          DefaultListenerName,
+		tlsConfig:     s.TLSConfig,
+		proxyProtocol: s.cfg.ProxyProtocol,
+		ln:            ln,
+	}, nil
+}
+
+//listenConfig 按监听器配置监听额外的地址，未配置名称时使用监听地址作为名称
+func (s *Server) listenConfig(lc utils.ListenerConfig) (*listener, error) {
+	mode, err := parseSocketMode(lc.UnixSocketMode)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := lc.TLSConfig
+	if tlsConfig == nil && lc.TLSCertFile != "" {
+		tlsConfig, err = loadTLSConfig(lc.TLSCertFile, lc.TLSKeyFile, lc.TLSClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	network := lc.Network
+	if network == "" {
+		network = "tcp"
+	}
+	ln, err := listen(network, lc.Address, mode)
+	if err != nil {
+		return nil, err
+	}
+
+	name := lc.Name
+	if name == "" {
+		name = lc.Address
+	}
+	return &listener{
+		name:          name,
+		maxConn:       lc.MaxConn,
+		tlsConfig:     tlsConfig,
+		proxyProtocol: lc.ProxyProtocol,
+		ln:            ln,
+	}, nil
+}
+
+//listen 按网络类型监听地址，unix时mode为socket文件的权限
+func listen(network, address string, mode os.FileMode) (net.Listener, error) {
+	if network == NetworkUnix {
+		return listenUnix(address, mode)
+	}
+
+	//获取一个TCP的Addr
+	addr, err := net.ResolveTCPAddr(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return net.ListenTCP(network, addr)
+}
+
+//parseSocketMode 解析八进制字符串表示的socket文件权限，为空时返回0
+func parseSocketMode(s string) (os.FileMode, error) {
+	if s == "" {
+		return 0, nil
+	}
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid unix_socket_mode %q: %w", s, err)
+	}
+	return os.FileMode(mode), nil
+}
+
+//listenUnix 监听Unix socket，先清理上次未正常退出遗留的socket文件，监听器关闭时socket文件会被删除
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+
+	listener, err := net.ListenUnix(NetworkUnix, &net.UnixAddr{Name: path, Net: NetworkUnix})
+	if err != nil {
+		return nil, err
+	}
+	if mode != 0 {
+		if err := os.Chmod(path, mode); err != nil {
+			listener.Close()
+			return nil, err
+		}
+	}
+	return listener, nil
+}
+
+//removeStaleSocket 删除已无进程监听的socket文件，路径不是socket文件或仍有进程监听时返回错误
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s already exists and is not a unix socket", path)
+	}
+
+	conn, err := net.DialTimeout(NetworkUnix, path, time.Second)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("%s: %w", path, ErrSocketInUse)
+	}
+	return os.Remove(path)
+}
@@ -0,0 +1,249 @@
+package impl
+
+import (
+	"crypto/tls"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ajdwfnhaps/easy-tcp-server/iface"
+	"github.com/ajdwfnhaps/easy-tcp-server/utils"
+)
+
+func tempSocketDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "sock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestUnixSocketServer(t *testing.T) {
+	dir := tempSocketDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "iot.sock")
+
+	//模拟上次未正常退出遗留的socket文件
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+
+	s := NewServer(WithUnixSocket(path, 0600)).(*Server)
+	s.AddRouter("request_echo", &echoRouter{})
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Fatalf("unexpected socket mode %v", fi.Mode().Perm())
+	}
+
+	client, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(3 * time.Second))
+	req := `{"cmd":"request_echo"}`
+	if err := writeTestMsg(client, s.GetDataPack(), req); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := readTestMsg(client, s.GetDataPack())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(msg.GetBody()) != req {
+		t.Fatalf("unexpected reply %s", msg.GetBody())
+	}
+
+	s.Stop()
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		t.Fatalf("socket file should be removed on stop, err=%v", err)
+	}
+}
+
+func TestUnixSocketInUse(t *testing.T) {
+	dir := tempSocketDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "iot.sock")
+
+	first := NewServer(WithUnixSocket(path, 0))
+	if err := first.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer first.Stop()
+
+	//仍有进程监听的socket文件不能被删除
+	if err := NewServer(WithUnixSocket(path, 0)).Start(); !errors.Is(err, ErrSocketInUse) {
+		t.Fatalf("expected ErrSocketInUse, got %v", err)
+	}
+
+	//非socket文件不能被删除
+	regular := filepath.Join(dir, "regular")
+	if err := ioutil.WriteFile(regular, []byte("data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewServer(WithUnixSocket(regular, 0)).Start(); err == nil {
+		t.Fatal("expected error for regular file")
+	}
+	if _, err := os.Stat(regular); err != nil {
+		t.Fatalf("regular file must be kept, err=%v", err)
+	}
+}
+
+func TestUnixSocketConfig(t *testing.T) {
+	dir := tempSocketDir(t)
+	defer os.RemoveAll(dir)
+
+	cfg := utils.NewConfig()
+	cfg.Network = "unix"
+	cfg.Address = filepath.Join(dir, "iot.sock")
+	cfg.UnixSocketMode = "0640"
+	s := NewServerWithConfig(cfg)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	fi, err := os.Stat(cfg.Address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0640 {
+		t.Fatalf("unexpected socket mode %v", fi.Mode().Perm())
+	}
+
+	cfg = utils.NewConfig()
+	cfg.Network = "unix"
+	cfg.Address = filepath.Join(dir, "bad.sock")
+	cfg.UnixSocketMode = "rw-r"
+	if err := NewServerWithConfig(cfg).Start(); err == nil {
+		t.Fatal("expected error for invalid unix_socket_mode")
+	}
+}
+
+func TestServerMultipleListeners(t *testing.T) {
+	ca := newTestCert(t, "test-ca", nil)
+	serverCert := newTestCert(t, "server", ca)
+
+	s := NewServer(
+		WithAddr("127.0.0.1", 0),
+		WithListener(utils.ListenerConfig{
+			Name:      "tls",
+			Address:   "127.0.0.1:0",
+			TLSConfig: &tls.Config{Certificates: []tls.Certificate{serverCert.tlsCert(t)}},
+		}),
+		WithListener(utils.ListenerConfig{
+			Name:    "limited",
+			Network: "tcp4",
+			Address: "127.0.0.1:0",
+			MaxConn: 1,
+		}),
+	).(*Server)
+	s.AddRouter("request_echo", &echoRouter{})
+
+	type started struct {
+		name  string
+		count int
+	}
+	startedChan := make(chan started, 4)
+	s.SetOnConnStart(func(conn iface.IConnection) {
+		l := conn.GetListener()
+		startedChan <- started{l.Name(), l.ConnCount()}
+	})
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	listeners := s.Listeners()
+	if len(listeners) != 3 || listeners[0].Name() != DefaultListenerName || listeners[0].Addr().String() != s.Addr().String() {
+		t.Fatalf("unexpected listeners %v", listeners)
+	}
+	byName := map[string]iface.IListener{}
+	for _, l := range listeners {
+		byName[l.Name()] = l
+	}
+
+	echo := func(client net.Conn) {
+		client.SetDeadline(time.Now().Add(3 * time.Second))
+		req := `{"cmd":"request_echo"}`
+		if err := writeTestMsg(client, s.GetDataPack(), req); err != nil {
+			t.Fatal(err)
+		}
+		msg, err := readTestMsg(client, s.GetDataPack())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(msg.GetBody()) != req {
+			t.Fatalf("unexpected reply %s", msg.GetBody())
+		}
+	}
+
+	plain, err := net.Dial("tcp", byName[DefaultListenerName].Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	echo(plain)
+
+	secure, err := tls.Dial("tcp", byName["tls"].Addr().String(), &tls.Config{RootCAs: certPool(ca)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer secure.Close()
+	echo(secure)
+
+	limited, err := net.Dial("tcp", byName["limited"].Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo(limited)
+
+	for _, want := range []string{DefaultListenerName, "tls", "limited"} {
+		got := <-startedChan
+		if got.name != want || got.count != 1 {
+			t.Fatalf("expected %s with 1 conn, got %+v", want, got)
+		}
+	}
+	if s.ConnMgr.Len() != 3 {
+		t.Fatalf("listeners should share the conn manager, got %d", s.ConnMgr.Len())
+	}
+
+	//超过监听器连接数上限的连接被关闭
+	rejected, err := net.Dial("tcp", byName["limited"].Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rejected.Close()
+	rejected.SetDeadline(time.Now().Add(3 * time.Second))
+	if _, err := rejected.Read(make([]byte, 1)); err == nil {
+		t.Fatal("conn over listener max_conn should be closed")
+	}
+
+	//连接关闭后监听器连接数减少，可再次接入
+	limited.Close()
+	for i := 0; byName["limited"].ConnCount() != 0; i++ {
+		if i > 300 {
+			t.Fatal("listener conn count not released")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	again, err := net.Dial("tcp", byName["limited"].Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer again.Close()
+	echo(again)
+}
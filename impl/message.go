@@ -1,5 +1,8 @@
 package impl
 
+//DefaultVersion 默认的协议版本号
+var DefaultVersion = [4]byte{'2', '0', '0', '1'}
+
 //Message 消息
 type Message struct {
 	BodySize   int32
@@ -13,7 +16,7 @@ type Message struct {
 //NewMsgPackage 创建一个Message消息包
 func NewMsgPackage(bodyData []byte) *Message {
 	var msg = &Message{
-		Version:    [4]byte{'2', '0', '0', '1'},
+		Version:    DefaultVersion,
 		Compress:   0,
 		ClientType: 0,
 	}
@@ -1,73 +1,237 @@
 package impl
 
 import (
+	"context"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ajdwfnhaps/easy-tcp-server/dto"
 	"github.com/ajdwfnhaps/easy-tcp-server/iface"
 	"github.com/ajdwfnhaps/easy-tcp-server/utils"
 )
 
 type MsgHandle struct {
+	pending        int64                    //已入队及正在处理的请求数量，原子操作，放在首位保证64位对齐
 	Apis           map[string]iface.IRouter //存放每个MsgId 所对应的处理方法的map属性
 	WorkerPoolSize uint32                   //业务工作Worker池的数量
 	TaskQueue      []chan iface.IRequest    //Worker负责取任务的消息队列
 
+	quit     chan struct{} //通知worker退出
+	quitOnce sync.Once     //保证quit只关闭一次
+
+	middlewares []iface.Middleware      //全局中间件，包装所有请求的处理
+	groups      map[string]*RouterGroup //通过分组注册的路由所属的分组
+
+	HandlerTimeout time.Duration            //处理请求的默认超时时间，0为不限制
+	routeTimeouts  map[string]time.Duration //各路由的超时时间，优先于HandlerTimeout，小于0为不限制
+
+	OnPanic          func(request iface.IRequest, err interface{})       //处理请求发生panic时的Hook函数
+	OnHandlerTimeout func(request iface.IRequest, timeout time.Duration) //处理请求超时时的Hook函数，可用于统计慢请求
+
+	ResponseEncoder iface.ResponseEncoder //错误响应的编码方法
+	NotFoundHandler iface.NotFoundHandler //找不到路由时的响应方法
+	ErrorHandler    iface.ErrorHandler    //处理请求出错时的响应方法
+
+	cfg *utils.GlobalObj //所属Server的配置
 }
 
 func NewMsgHandle() *MsgHandle {
-	return &MsgHandle{
+	return newMsgHandle(utils.GlobalObject)
+}
+
+//newMsgHandle 使用指定配置创建消息管理模块
+func newMsgHandle(cfg *utils.GlobalObj) *MsgHandle {
+	mh := &MsgHandle{
 		Apis:           make(map[string]iface.IRouter),
-		WorkerPoolSize: utils.GlobalObject.WorkerPoolSize,
+		WorkerPoolSize: cfg.WorkerPoolSize,
 		//一个worker对应一个queue
-		TaskQueue: make([]chan iface.IRequest, utils.GlobalObject.WorkerPoolSize),
+		TaskQueue: make([]chan iface.IRequest, cfg.WorkerPoolSize),
+		cfg:       cfg,
+		quit:      make(chan struct{}),
+		groups:    make(map[string]*RouterGroup),
+
+		HandlerTimeout: time.Duration(cfg.HandlerTimeoutMs) * time.Millisecond,
+		routeTimeouts:  make(map[string]time.Duration),
+
+		ResponseEncoder: DefaultResponseEncoder,
+		NotFoundHandler: DefaultNotFoundHandler,
+		ErrorHandler:    DefaultErrorHandler,
 	}
+	for cmd, ms := range cfg.RouteTimeoutsMs {
+		mh.SetRouteTimeout(cmd, time.Duration(ms)*time.Millisecond)
+	}
+	return mh
 }
 
 //SendMsgToTaskQueue 将消息交给TaskQueue,由worker进行处理
 func (mh *MsgHandle) SendMsgToTaskQueue(request iface.IRequest) {
 	//根据ConnID来分配当前的连接应该由哪个worker负责处理
 	//轮询的平均分配法则
+	atomic.AddInt64(&mh.pending, 1)
+
+	if mh.WorkerPoolSize == 0 {
+		//未启动工作池机制，直接开启goroutine执行对应的Handle方法
+		go func() {
+			defer atomic.AddInt64(&mh.pending, -1)
+			mh.DoMsgHandler(request)
+		}()
+		return
+	}
 
 	//得到需要处理此条连接的workerID
 	workerID := request.GetConnection().GetConnID() % mh.WorkerPoolSize
-	utils.GlobalObject.Logger.Info("ConnID=", request.GetConnection().GetConnID(), " request-cmd=", request.GetRouterCmd(), "分配给 workerID=", workerID, " 来处理")
+	mh.cfg.Logger.Info("ConnID=", request.GetConnection().GetConnID(), " request-cmd=", request.GetRouterCmd(), "分配给 workerID=", workerID, " 来处理")
 	//将请求消息发送给任务队列
 	mh.TaskQueue[workerID] <- request
 }
 
 //DoMsgHandler 马上以非阻塞方式处理消息
+//设置了超时时间时，请求的Context从此刻开始计时，超时后回复ErrHandlerTimeout的错误响应并立即返回，
+//不再等待仍在运行的处理方法，保证worker继续处理其他连接的请求。后台运行的处理方法同样计入pending，Shutdown会等待其返回
 func (mh *MsgHandle) DoMsgHandler(request iface.IRequest) {
-	cmd := request.GetRouterCmd()
-	//utils.GlobalObject.Logger.Info("msg cmd=", cmd)
-	handler, ok := mh.Apis[cmd]
-	if !ok {
-		errMsg := "handler cmd = " + cmd + " is not FOUND!"
-		utils.GlobalObject.Logger.Error(errMsg)
-		request.GetConnection().SendMsg([]byte(`{
-			"status": -1,
-			"cmd":"unkown-action",
-			"seqno":"",
-			"msg": "` + errMsg + `"
-	}`))
+	timeout := mh.routeTimeout(request.GetRouterCmd())
+	if timeout <= 0 {
+		if ret, ok := mh.serve(request); ok {
+			mh.reply(request, ret)
+		}
 		return
 	}
 
-	//执行对应处理方法
-	handler.PreHandle(request)
+	ctx, cancel := context.WithTimeout(request.Context(), timeout)
+	defer cancel()
+	if r, ok := request.(*Request); ok {
+		request = r.WithContext(ctx)
+	}
+
+	type result struct {
+		ret dto.Result
+		ok  bool
+	}
+	done := make(chan result, 1)
+	atomic.AddInt64(&mh.pending, 1)
+	go func() {
+		defer atomic.AddInt64(&mh.pending, -1)
+		ret, ok := mh.serve(request)
+		done <- result{ret, ok}
+	}()
+
+	select {
+	case res := <-done:
+		if res.ok {
+			mh.reply(request, res.ret)
+		}
+	case <-ctx.Done():
+		if ctx.Err() != context.DeadlineExceeded {
+			//连接已关闭，无需回复
+			return
+		}
+		mh.cfg.Logger.Warnf("处理请求超时: ConnID=%d, cmd=%s, timeout=%s，处理方法仍在后台运行",
+			request.GetConnection().GetConnID(), request.GetRouterCmd(), timeout)
+		mh.callOnHandlerTimeout(request, timeout)
+		mh.reply(request, mh.ErrorHandler(request, ErrHandlerTimeout))
+	}
+}
+
+//serve 执行中间件及路由，返回需要回复客户端的错误响应，无需回复时ok为false
+//全局中间件按注册顺序由外到内包装整个处理过程，分组中间件只包装该分组的路由
+func (mh *MsgHandle) serve(request iface.IRequest) (ret dto.Result, ok bool) {
+	defer mh.recoverPanic(request, &ret, &ok)
 
-	if err := handler.Handle(request); err != nil {
-		ret := request.GetRet()
-		errMsg := err.Error()
-		request.GetConnection().SendMsg([]byte(`{
-			"status": -1,
-			"cmd":"` + ret.Cmd + `",
-			"seqno":"` + ret.Seqno + `",
-			"msg": "` + errMsg + `"
-	}`))
+	handler := mh.routeHandler(request.GetRouterCmd())
+	for i := len(mh.middlewares) - 1; i >= 0; i-- {
+		handler = mh.middlewares[i](handler)
+	}
 
-		utils.GlobalObject.Logger.Errorf("DoMsgHandler Err: %s", errMsg)
+	if err := handler(request); err != nil {
+		return mh.errorResult(request, err), true
+	}
+	return dto.Result{}, false
+}
+
+//routeTimeout 获取cmd的超时时间，未单独设置时使用HandlerTimeout
+func (mh *MsgHandle) routeTimeout(cmd string) time.Duration {
+	if timeout, ok := mh.routeTimeouts[cmd]; ok {
+		return timeout
+	}
+	return mh.HandlerTimeout
+}
+
+//recoverPanic 恢复处理请求时发生的panic，记录堆栈并将错误响应写入ret，保证worker继续工作
+func (mh *MsgHandle) recoverPanic(request iface.IRequest, ret *dto.Result, ok *bool) {
+	r := recover()
+	if r == nil {
 		return
 	}
 
-	handler.PostHandle(request)
+	mh.cfg.Logger.Errorf("DoMsgHandler panic: ConnID=%d, cmd=%s, err=%v\n%s",
+		request.GetConnection().GetConnID(), request.GetRouterCmd(), r, debug.Stack())
+
+	mh.callOnPanic(request, r)
+	*ret, *ok = mh.ErrorHandler(request, ErrInternal), true
+}
+
+//callOnHandlerTimeout 调用OnHandlerTimeout Hook函数，Hook函数本身的panic同样会被恢复
+func (mh *MsgHandle) callOnHandlerTimeout(request iface.IRequest, timeout time.Duration) {
+	if mh.OnHandlerTimeout == nil {
+		return
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			mh.cfg.Logger.Errorf("OnHandlerTimeout hook panic: %v", r)
+		}
+	}()
+	mh.OnHandlerTimeout(request, timeout)
+}
+
+//SetOnHandlerTimeout 设置处理请求超时时的Hook函数
+func (mh *MsgHandle) SetOnHandlerTimeout(hookFunc func(request iface.IRequest, timeout time.Duration)) {
+	mh.OnHandlerTimeout = hookFunc
+}
+
+//callOnPanic 调用OnPanic Hook函数，Hook函数本身的panic同样会被恢复
+func (mh *MsgHandle) callOnPanic(request iface.IRequest, err interface{}) {
+	if mh.OnPanic == nil {
+		return
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			mh.cfg.Logger.Errorf("OnPanic hook panic: %v", r)
+		}
+	}()
+	mh.OnPanic(request, err)
+}
+
+//SetOnPanic 设置处理请求发生panic时的Hook函数
+func (mh *MsgHandle) SetOnPanic(hookFunc func(request iface.IRequest, err interface{})) {
+	mh.OnPanic = hookFunc
+}
+
+//routeHandler 获取cmd对应的处理方法，已包装所属分组的中间件
+func (mh *MsgHandle) routeHandler(cmd string) iface.HandlerFunc {
+	router, ok := mh.Apis[cmd]
+	if !ok {
+		return mh.replyNotFound
+	}
+
+	var handler iface.HandlerFunc = func(request iface.IRequest) error {
+		//执行对应处理方法
+		router.PreHandle(request)
+		if err := router.Handle(request); err != nil {
+			return err
+		}
+		router.PostHandle(request)
+		return nil
+	}
+
+	if group, ok := mh.groups[cmd]; ok {
+		middlewares := group.chain()
+		for i := len(middlewares) - 1; i >= 0; i-- {
+			handler = middlewares[i](handler)
+		}
+	}
+	return handler
 }
 
 //AddRouter 为消息添加具体的处理逻辑
@@ -78,20 +242,47 @@ func (mh *MsgHandle) AddRouter(cmd string, router iface.IRouter) {
 	}
 	//2 添加msg与api的绑定关系
 	mh.Apis[cmd] = router
-	if utils.GlobalObject.Logger != nil {
-		utils.GlobalObject.Logger.Info("Add tcp handler cmd = ", cmd)
+	if mh.cfg.Logger != nil {
+		mh.cfg.Logger.Info("Add tcp handler cmd = ", cmd)
+	}
+}
+
+//SetRouteTimeout 设置路由的超时时间，从开始处理请求时计时，作为请求Context的截止时间。
+//0时使用默认超时时间HandlerTimeout，小于0为不限制
+func (mh *MsgHandle) SetRouteTimeout(cmd string, timeout time.Duration) {
+	if timeout == 0 {
+		delete(mh.routeTimeouts, cmd)
+		return
+	}
+	mh.routeTimeouts[cmd] = timeout
+}
+
+//Use 添加全局中间件，按添加顺序由外到内执行
+func (mh *MsgHandle) Use(middlewares ...iface.Middleware) {
+	mh.middlewares = append(mh.middlewares, middlewares...)
+}
+
+//Group 创建路由分组，组内路由在全局中间件之后执行该组的中间件
+func (mh *MsgHandle) Group(middlewares ...iface.Middleware) iface.IRouterGroup {
+	return &RouterGroup{
+		msgHandler:  mh,
+		middlewares: middlewares,
 	}
 }
 
 //StartOneWorker 启动一个Worker工作流程
 func (mh *MsgHandle) StartOneWorker(workerID int, taskQueue chan iface.IRequest) {
-	utils.GlobalObject.Logger.Info("Tcp-Worker ID = ", workerID, " is started.")
+	mh.cfg.Logger.Info("Tcp-Worker ID = ", workerID, " is started.")
 	//不断的等待队列中的消息
 	for {
 		select {
 		//有消息则取出队列的Request，并执行绑定的业务方法
 		case request := <-taskQueue:
 			mh.DoMsgHandler(request)
+			atomic.AddInt64(&mh.pending, -1)
+		case <-mh.quit:
+			mh.cfg.Logger.Info("Tcp-Worker ID = ", workerID, " is stopped.")
+			return
 		}
 	}
 }
@@ -102,8 +293,32 @@ func (mh *MsgHandle) StartWorkerPool() {
 	for i := 0; i < int(mh.WorkerPoolSize); i++ {
 		//一个worker被启动
 		//给当前worker对应的任务队列开辟空间
-		mh.TaskQueue[i] = make(chan iface.IRequest, utils.GlobalObject.MaxWorkerTaskLen)
+		mh.TaskQueue[i] = make(chan iface.IRequest, mh.cfg.MaxWorkerTaskLen)
 		//启动当前Worker，阻塞的等待对应的任务队列是否有消息传递进来
 		go mh.StartOneWorker(i, mh.TaskQueue[i])
 	}
 }
+
+//Stop 立即停止worker工作池，不等待已入队及正在处理的请求，可重复调用
+func (mh *MsgHandle) Stop() {
+	mh.quitOnce.Do(func() {
+		close(mh.quit)
+	})
+}
+
+//Shutdown 等待已入队及正在处理的请求全部完成后停止worker工作池，包括超时后仍在后台运行的处理方法，
+//ctx超时则直接停止并返回ctx的错误
+func (mh *MsgHandle) Shutdown(ctx context.Context) error {
+	defer mh.Stop()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for atomic.LoadInt64(&mh.pending) > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
@@ -0,0 +1,436 @@
+package impl
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ajdwfnhaps/easy-tcp-server/dto"
+	"github.com/ajdwfnhaps/easy-tcp-server/iface"
+	"github.com/ajdwfnhaps/easy-tcp-server/utils"
+)
+
+//callRecorder 记录中间件及路由的执行顺序
+type callRecorder struct {
+	mu    sync.Mutex
+	calls []string
+}
+
+func (r *callRecorder) record(call string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls = append(r.calls, call)
+}
+
+func (r *callRecorder) take() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	calls := strings.Join(r.calls, " ")
+	r.calls = nil
+	return calls
+}
+
+func (r *callRecorder) middleware(name string) iface.Middleware {
+	return func(next iface.HandlerFunc) iface.HandlerFunc {
+		return func(req iface.IRequest) error {
+			r.record(name + ">")
+			err := next(req)
+			r.record("<" + name)
+			return err
+		}
+	}
+}
+
+//recordRouter 记录执行并返回固定结果的路由
+type recordRouter struct {
+	BaseRouter
+	rec  *callRecorder
+	name string
+}
+
+func (rr *recordRouter) Handle(req iface.IRequest) error {
+	rr.rec.record(rr.name)
+	return nil
+}
+
+//replyMiddleware 在请求处理完成后回复客户端，用于同步测试
+func replyMiddleware(next iface.HandlerFunc) iface.HandlerFunc {
+	return func(req iface.IRequest) error {
+		if err := next(req); err != nil {
+			return err
+		}
+		return req.GetConnection().SendMsg([]byte(`{"status":0,"cmd":"done"}`))
+	}
+}
+
+//roundTrip 发送一个请求并读取响应
+func roundTrip(t *testing.T, s *Server, body string) dto.Result {
+	client, _ := dialTestConn(t, s)
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(3 * time.Second))
+
+	if err := writeTestMsg(client, s.GetDataPack(), body); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := readTestMsg(client, s.GetDataPack())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ret dto.Result
+	if err := json.Unmarshal(msg.GetBody(), &ret); err != nil {
+		t.Fatalf("invalid json reply %s: %v", msg.GetBody(), err)
+	}
+	return ret
+}
+
+func TestMsgHandleMiddlewareOrder(t *testing.T) {
+	rec := &callRecorder{}
+	s := newTestServer()
+	s.Use(replyMiddleware, rec.middleware("A"))
+	s.AddRouter("request_plain", &recordRouter{rec: rec, name: "plain"})
+
+	group := s.Group(rec.middleware("C"))
+	sub := group.Group(rec.middleware("D"))
+	sub.AddRouter("request_nested", &recordRouter{rec: rec, name: "nested"})
+	//路由注册之后添加的中间件同样生效
+	s.Use(rec.middleware("B"))
+
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	roundTrip(t, s, `{"cmd":"request_nested"}`)
+	if got, want := rec.take(), "A> B> C> D> nested <D <C <B <A"; got != want {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+
+	roundTrip(t, s, `{"cmd":"request_plain"}`)
+	if got, want := rec.take(), "A> B> plain <B <A"; got != want {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+}
+
+func TestMsgHandleMiddlewareShortCircuit(t *testing.T) {
+	rec := &callRecorder{}
+	s := newTestServer()
+	s.Use(func(next iface.HandlerFunc) iface.HandlerFunc {
+		return func(req iface.IRequest) error {
+			if req.GetRet().Seqno != "token" {
+				return errors.New("unauthorized")
+			}
+			return next(req)
+		}
+	})
+	s.AddRouter("request_secret", &recordRouter{rec: rec, name: "secret"})
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	ret := roundTrip(t, s, `{"cmd":"request_secret","seqno":"guest"}`)
+	if ret.Status != -1 || ret.Msg != "unauthorized" || ret.Seqno != "guest" {
+		t.Fatalf("unexpected reply %+v", ret)
+	}
+	if calls := rec.take(); calls != "" {
+		t.Fatalf("handler should not run, got %q", calls)
+	}
+}
+
+//panicRouter 处理时发生panic的路由
+type panicRouter struct {
+	BaseRouter
+}
+
+func (r *panicRouter) Handle(req iface.IRequest) error {
+	panic("boom")
+}
+
+func TestMsgHandleRecoversPanic(t *testing.T) {
+	s := newTestServer()
+	s.AddRouter("request_panic", &panicRouter{})
+	s.AddRouter("request_echo", &echoRouter{})
+	panicChan := make(chan interface{}, 1)
+	s.SetOnPanic(func(req iface.IRequest, err interface{}) {
+		panicChan <- err
+	})
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	client, _ := dialTestConn(t, s)
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(3 * time.Second))
+
+	if err := writeTestMsg(client, s.GetDataPack(), `{"cmd":"request_panic","seqno":"p1"}`); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := readTestMsg(client, s.GetDataPack())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ret dto.Result
+	if err := json.Unmarshal(msg.GetBody(), &ret); err != nil || ret.Status != -1 || ret.Seqno != "p1" {
+		t.Fatalf("unexpected panic reply %s", msg.GetBody())
+	}
+	if err := <-panicChan; err != "boom" {
+		t.Fatalf("unexpected OnPanic value %v", err)
+	}
+
+	//同一连接由同一个worker处理，worker恢复后应继续工作
+	req := `{"cmd":"request_echo","seqno":"e1"}`
+	if err := writeTestMsg(client, s.GetDataPack(), req); err != nil {
+		t.Fatal(err)
+	}
+	msg, err = readTestMsg(client, s.GetDataPack())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(msg.GetBody()) != req {
+		t.Fatalf("unexpected echo %s", msg.GetBody())
+	}
+}
+
+//errRouter 返回指定错误的路由
+type errRouter struct {
+	BaseRouter
+	err error
+}
+
+func (r *errRouter) Handle(req iface.IRequest) error {
+	return r.err
+}
+
+func TestMsgHandleErrorReplyIsValidJSON(t *testing.T) {
+	s := newTestServer()
+	errMsg := "bad \"quoted\" value\nnext line \\ end"
+	s.AddRouter("request_fail", &errRouter{err: errors.New(errMsg)})
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	ret := roundTrip(t, s, `{"cmd":"request_fail","seqno":"a\"b"}`)
+	if ret.Status != -1 || ret.Cmd != "request_fail" || ret.Seqno != `a"b` || ret.Msg != errMsg {
+		t.Fatalf("unexpected error reply %+v", ret)
+	}
+
+	ret = roundTrip(t, s, `{"cmd":"request_\"missing\"","seqno":"1"}`)
+	if ret.Status != -1 || ret.Cmd != "unkown-action" || !strings.Contains(ret.Msg, `request_"missing"`) {
+		t.Fatalf("unexpected not found reply %+v", ret)
+	}
+}
+
+func TestMsgHandleCustomErrorHandlers(t *testing.T) {
+	s := newTestServer()
+	s.AddRouter("request_fail", &errRouter{err: errors.New("failed")})
+	s.SetErrorHandler(func(req iface.IRequest, err error) dto.Result {
+		return dto.Result{Status: 500, Cmd: "response_" + req.GetRouterCmd(), Seqno: req.GetRet().Seqno, Msg: err.Error()}
+	})
+	s.SetNotFoundHandler(func(req iface.IRequest) dto.Result {
+		return dto.Result{Status: 404, Cmd: "response_" + req.GetRouterCmd(), Seqno: req.GetRet().Seqno}
+	})
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	ret := roundTrip(t, s, `{"cmd":"request_fail","seqno":"1"}`)
+	if ret.Status != 500 || ret.Cmd != "response_request_fail" || ret.Seqno != "1" {
+		t.Fatalf("unexpected error reply %+v", ret)
+	}
+
+	ret = roundTrip(t, s, `{"cmd":"request_missing","seqno":"2"}`)
+	if ret.Status != 404 || ret.Cmd != "response_request_missing" || ret.Seqno != "2" {
+		t.Fatalf("unexpected not found reply %+v", ret)
+	}
+}
+
+//funcRouter 使用指定方法处理请求的路由
+type funcRouter struct {
+	BaseRouter
+	handle func(req iface.IRequest) error
+}
+
+func (r *funcRouter) Handle(req iface.IRequest) error {
+	return r.handle(req)
+}
+
+func TestMsgHandleContextCancelledOnDisconnect(t *testing.T) {
+	s := newTestServer()
+	started := make(chan struct{})
+	errChan := make(chan error, 1)
+	s.AddRouter("request_wait", &funcRouter{handle: func(req iface.IRequest) error {
+		close(started)
+		<-req.Context().Done()
+		errChan <- req.Context().Err()
+		return nil
+	}})
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	client, _ := dialTestConn(t, s)
+	if err := writeTestMsg(client, s.GetDataPack(), `{"cmd":"request_wait","seqno":"1"}`); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-started:
+	case <-time.After(3 * time.Second):
+		t.Fatal("handler was not called")
+	}
+	client.Close()
+
+	select {
+	case err := <-errChan:
+		if err != context.Canceled {
+			t.Fatalf("expected context.Canceled, got %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("request context was not cancelled after disconnect")
+	}
+}
+
+func TestMsgHandleRouteTimeout(t *testing.T) {
+	s := newTestServer()
+	s.SetRouteTimeout("request_slow", 50*time.Millisecond)
+	errChan := make(chan error, 1)
+	release := make(chan struct{})
+	s.AddRouter("request_slow", &funcRouter{handle: func(req iface.IRequest) error {
+		<-req.Context().Done()
+		errChan <- req.Context().Err()
+		//超时后才返回，避免与超时响应竞争
+		<-release
+		return nil
+	}})
+	s.AddRouter("request_fast", &funcRouter{handle: func(req iface.IRequest) error {
+		if _, ok := req.Context().Deadline(); ok {
+			return errors.New("unexpected deadline")
+		}
+		return nil
+	}})
+	s.Use(replyMiddleware)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	begin := time.Now()
+	ret := roundTrip(t, s, `{"cmd":"request_slow","seqno":"1"}`)
+	close(release)
+	if ret.Status != -1 || ret.Msg != ErrHandlerTimeout.Error() {
+		t.Fatalf("unexpected reply %+v", ret)
+	}
+	if time.Since(begin) < 50*time.Millisecond {
+		t.Fatal("request context expired before the route timeout")
+	}
+	if err := <-errChan; err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+
+	ret = roundTrip(t, s, `{"cmd":"request_fast","seqno":"2"}`)
+	if ret.Status != 0 || ret.Cmd != "done" {
+		t.Fatalf("unexpected reply %+v", ret)
+	}
+}
+
+func TestMsgHandleHandlerTimeoutFreesWorker(t *testing.T) {
+	cfg := utils.NewConfig()
+	cfg.WorkerPoolSize = 1
+	cfg.HandlerTimeoutMs = 100
+	cfg.RouteTimeoutsMs = map[string]int{"request_report": -1}
+	s := NewServerWithConfig(cfg).(*Server)
+	s.IP = "127.0.0.1"
+	s.Port = 0
+
+	release := make(chan struct{})
+	defer close(release)
+	s.AddRouter("request_stuck", &funcRouter{handle: func(req iface.IRequest) error {
+		//不理会Context的处理方法
+		<-release
+		return errors.New("late error")
+	}})
+	s.AddRouter("request_report", &funcRouter{handle: func(req iface.IRequest) error {
+		if _, ok := req.Context().Deadline(); ok {
+			return errors.New("unexpected deadline")
+		}
+		return nil
+	}})
+	s.Use(replyMiddleware)
+	timeouts := make(chan string, 1)
+	s.SetOnHandlerTimeout(func(req iface.IRequest, timeout time.Duration) {
+		if timeout != 100*time.Millisecond {
+			t.Errorf("unexpected timeout %s", timeout)
+		}
+		timeouts <- req.GetRouterCmd()
+	})
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	ret := roundTrip(t, s, `{"cmd":"request_stuck","seqno":"7"}`)
+	if ret.Status != -1 || ret.Cmd != "request_stuck" || ret.Seqno != "7" || ret.Msg != ErrHandlerTimeout.Error() {
+		t.Fatalf("unexpected timeout reply %+v", ret)
+	}
+	select {
+	case cmd := <-timeouts:
+		if cmd != "request_stuck" {
+			t.Fatalf("unexpected timeout cmd %s", cmd)
+		}
+	default:
+		t.Fatal("OnHandlerTimeout was not called")
+	}
+
+	//唯一的worker已释放，其他连接的请求可以继续处理
+	ret = roundTrip(t, s, `{"cmd":"request_report","seqno":"8"}`)
+	if ret.Status != 0 || ret.Cmd != "done" {
+		t.Fatalf("unexpected reply %+v", ret)
+	}
+}
+
+func TestMsgHandleShutdownWaitsTimedOutHandler(t *testing.T) {
+	s := newTestServer()
+	s.SetRouteTimeout("request_stuck", 50*time.Millisecond)
+	release := make(chan struct{})
+	s.AddRouter("request_stuck", &funcRouter{handle: func(req iface.IRequest) error {
+		<-release
+		return nil
+	}})
+	s.Use(replyMiddleware)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	ret := roundTrip(t, s, `{"cmd":"request_stuck","seqno":"1"}`)
+	if ret.Msg != ErrHandlerTimeout.Error() {
+		t.Fatalf("unexpected reply %+v", ret)
+	}
+
+	//超时后仍在后台运行的处理方法返回之前，Shutdown不应返回
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- s.Shutdown(context.Background())
+	}()
+	select {
+	case err := <-errChan:
+		t.Fatalf("Shutdown returned %v before the timed out handler finished", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+	select {
+	case err := <-errChan:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("Shutdown did not return after the handler finished")
+	}
+}
@@ -0,0 +1,151 @@
+package impl
+
+import (
+	"crypto/tls"
+	"os"
+	"time"
+
+	"github.com/ajdwfnhaps/easy-logrus/logger"
+	"github.com/ajdwfnhaps/easy-tcp-server/iface"
+	"github.com/ajdwfnhaps/easy-tcp-server/utils"
+)
+
+//Option 创建Server时的可选配置
+type Option func(o *options)
+
+//options NewServer的选项，cfg为当前Server独立的配置副本
+type options struct {
+	cfg             *utils.GlobalObj
+	dataPack        iface.IDataPack
+	tlsConfig       *tls.Config
+	connIDGenerator iface.IConnIDGenerator
+	sendPolicy      *iface.SendPolicy
+	unixSocketMode  os.FileMode
+	listeners       []utils.ListenerConfig
+}
+
+//WithName 设置服务器名称
+func WithName(name string) Option {
+	return func(o *options) {
+		o.cfg.Name = name
+	}
+}
+
+//WithAddr 设置服务绑定的IP地址和端口，端口为0时由系统分配
+func WithAddr(host string, port int) Option {
+	return func(o *options) {
+		o.cfg.Host = host
+		o.cfg.TcpPort = port
+	}
+}
+
+//WithIPVersion 设置监听的网络类型：tcp(IPv4及IPv6双栈)、tcp4或tcp6
+func WithIPVersion(ipVersion string) Option {
+	return func(o *options) {
+		o.cfg.IPVersion = ipVersion
+	}
+}
+
+//WithMaxConn 设置允许的最大连接个数
+func WithMaxConn(maxConn int) Option {
+	return func(o *options) {
+		o.cfg.MaxConn = maxConn
+	}
+}
+
+//WithMaxConnPerIP 设置同一客户端IP允许的最大连接个数，0为不限制
+func WithMaxConnPerIP(maxConn int) Option {
+	return func(o *options) {
+		o.cfg.MaxConnPerIP = maxConn
+	}
+}
+
+//WithAcceptRate 设置每秒允许接入的连接数及瞬间允许接入的连接数，超过时拒绝新的连接
+func WithAcceptRate(rate float64, burst int) Option {
+	return func(o *options) {
+		o.cfg.AcceptRate = rate
+		o.cfg.AcceptBurst = burst
+	}
+}
+
+//WithAcceptRatePerIP 设置同一客户端IP每秒允许接入的连接数及瞬间允许接入的连接数
+func WithAcceptRatePerIP(rate float64, burst int) Option {
+	return func(o *options) {
+		o.cfg.AcceptRatePerIP = rate
+		o.cfg.AcceptBurstPerIP = burst
+	}
+}
+
+//WithWorkerPool 设置业务工作Worker池的数量及每个Worker任务队列的最大长度，size为0时不启用工作池
+func WithWorkerPool(size, queueLen uint32) Option {
+	return func(o *options) {
+		o.cfg.WorkerPoolSize = size
+		o.cfg.MaxWorkerTaskLen = queueLen
+	}
+}
+
+//WithLogger 设置日志框架
+func WithLogger(l logger.ILogger) Option {
+	return func(o *options) {
+		o.cfg.Logger = l
+	}
+}
+
+//WithDataPack 设置封包拆包实例
+func WithDataPack(dp iface.IDataPack) Option {
+	return func(o *options) {
+		o.dataPack = dp
+	}
+}
+
+//WithTLS 使用TLS加密连接，需要校验客户端证书时设置ClientAuth及ClientCAs
+func WithTLS(tlsConfig *tls.Config) Option {
+	return func(o *options) {
+		o.tlsConfig = tlsConfig
+	}
+}
+
+//WithUnixSocket 监听Unix socket文件，mode为socket文件的权限，0时使用系统默认
+func WithUnixSocket(path string, mode os.FileMode) Option {
+	return func(o *options) {
+		o.cfg.Network = NetworkUnix
+		o.cfg.Address = path
+		o.unixSocketMode = mode
+	}
+}
+
+//WithListener 额外监听一个地址，可多次使用，所有监听器共享路由、连接管理及广播
+func WithListener(lc utils.ListenerConfig) Option {
+	return func(o *options) {
+		o.listeners = append(o.listeners, lc)
+	}
+}
+
+//WithProxyProtocol 解析负载均衡发送的PROXY协议(v1、v2)头部，trustedProxies为受信任代理的CIDR列表，为空时信任所有对端
+func WithProxyProtocol(trustedProxies ...string) Option {
+	return func(o *options) {
+		o.cfg.ProxyProtocol = true
+		o.cfg.TrustedProxies = trustedProxies
+	}
+}
+
+//WithConnIDGenerator 设置连接ID生成器，如集群中使用NewNodeConnIDGenerator生成全局唯一的连接ID
+func WithConnIDGenerator(gen iface.IConnIDGenerator) Option {
+	return func(o *options) {
+		o.connIDGenerator = gen
+	}
+}
+
+//WithSendPolicy 设置连接发送队列已满时的背压策略，单次发送可通过SendBuffMsgWithPolicy指定
+func WithSendPolicy(policy iface.SendPolicy) Option {
+	return func(o *options) {
+		o.sendPolicy = &policy
+	}
+}
+
+//WithHandlerTimeout 设置处理请求的默认超时时间，超时后回复ErrHandlerTimeout的错误响应并释放worker
+func WithHandlerTimeout(timeout time.Duration) Option {
+	return func(o *options) {
+		o.cfg.HandlerTimeoutMs = int(timeout / time.Millisecond)
+	}
+}
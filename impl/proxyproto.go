@@ -0,0 +1,209 @@
+package impl
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//ErrProxyHeader 启用PROXY协议时，受信任的代理发送的PROXY协议头部无效
+var ErrProxyHeader = errors.New("invalid proxy protocol header")
+
+//ProxyHeaderTimeout 读取PROXY协议头部的超时时间
+var ProxyHeaderTimeout = 5 * time.Second
+
+var (
+	//proxyV1Prefix PROXY协议v1头部的前缀
+	proxyV1Prefix = []byte("PROXY ")
+	//proxyV2Signature PROXY协议v2头部的签名
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+//proxyV1MaxLen PROXY协议v1头部的最大长度，包括结尾的\r\n
+const proxyV1MaxLen = 107
+
+//proxyConn 经过PROXY协议代理的连接，读取头部后RemoteAddr返回真实的客户端地址
+type proxyConn struct {
+	net.Conn
+	reader *bufio.Reader
+
+	lock    sync.RWMutex
+	srcAddr net.Addr //头部中的客户端地址，LOCAL或UNKNOWN时为nil
+}
+
+func newProxyConn(conn net.Conn) *proxyConn {
+	return &proxyConn{
+		Conn:   conn,
+		reader: bufio.NewReader(conn),
+	}
+}
+
+//Read 读取头部之后的数据，包括读取头部时已缓冲的部分
+func (pc *proxyConn) Read(b []byte) (int, error) {
+	return pc.reader.Read(b)
+}
+
+//RemoteAddr 获取真实的客户端地址，头部未携带地址时返回代理的地址
+func (pc *proxyConn) RemoteAddr() net.Addr {
+	pc.lock.RLock()
+	defer pc.lock.RUnlock()
+
+	if pc.srcAddr != nil {
+		return pc.srcAddr
+	}
+	return pc.Conn.RemoteAddr()
+}
+
+//ProxyAddr 获取代理的地址
+func (pc *proxyConn) ProxyAddr() net.Addr {
+	return pc.Conn.RemoteAddr()
+}
+
+//readHeader 在timeout内读取并解析PROXY协议v1或v2头部，读超时由调用方清除
+func (pc *proxyConn) readHeader(timeout time.Duration) error {
+	pc.Conn.SetReadDeadline(time.Now().Add(timeout))
+
+	//v1最短的头部"PROXY UNKNOWN\r\n"也不少于v2签名的长度
+	sig, err := pc.reader.Peek(len(proxyV2Signature))
+	if err != nil {
+		return err
+	}
+
+	var addr net.Addr
+	switch {
+	case bytes.Equal(sig, proxyV2Signature):
+		addr, err = readProxyV2(pc.reader)
+	case bytes.HasPrefix(sig, proxyV1Prefix):
+		addr, err = readProxyV1(pc.reader)
+	default:
+		err = ErrProxyHeader
+	}
+	if err != nil {
+		return err
+	}
+
+	pc.lock.Lock()
+	pc.srcAddr = addr
+	pc.lock.Unlock()
+	return nil
+}
+
+//readProxyV1 解析文本格式的v1头部，如"PROXY TCP4 192.168.0.1 10.0.0.1 56324 8091\r\n"
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	line, err := r.ReadSlice('\n')
+	if err != nil {
+		if err == bufio.ErrBufferFull {
+			return nil, ErrProxyHeader
+		}
+		return nil, err
+	}
+	if len(line) > proxyV1MaxLen || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, ErrProxyHeader
+	}
+
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("%w: %q", ErrProxyHeader, line)
+	}
+
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("%w: %q", ErrProxyHeader, line)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+//readProxyV2 解析二进制格式的v2头部，LOCAL命令及非TCP地址族不携带客户端地址
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	head := make([]byte, 16)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, err
+	}
+	verCmd, family := head[12], head[13]
+	body := make([]byte, binary.BigEndian.Uint16(head[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	if verCmd>>4 != 2 {
+		return nil, fmt.Errorf("%w: version %d", ErrProxyHeader, verCmd>>4)
+	}
+	switch verCmd & 0x0f {
+	case 0x0: //LOCAL，代理自身的连接，如健康检查
+		return nil, nil
+	case 0x1: //PROXY
+	default:
+		return nil, fmt.Errorf("%w: command %d", ErrProxyHeader, verCmd&0x0f)
+	}
+
+	var ipLen int
+	switch family {
+	case 0x11: //TCP over IPv4
+		ipLen = net.IPv4len
+	case 0x21: //TCP over IPv6
+		ipLen = net.IPv6len
+	default:
+		return nil, nil
+	}
+	if len(body) < ipLen*2+4 {
+		return nil, fmt.Errorf("%w: address too short", ErrProxyHeader)
+	}
+	ip := make(net.IP, ipLen)
+	copy(ip, body[:ipLen])
+	port := binary.BigEndian.Uint16(body[ipLen*2:])
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+//parseTrustedProxies 解析受信任代理的CIDR列表，单个IP视为只包含该IP的网段
+func parseTrustedProxies(cidrs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", cidr)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", cidr, err)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+//isTrustedProxy 判断对端是否为受信任的代理，未配置受信任代理时信任所有对端，非IP地址(如Unix socket)的对端总是受信任
+func (s *Server) isTrustedProxy(addr net.Addr) bool {
+	if len(s.TrustedProxies) == 0 {
+		return true
+	}
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return true
+	}
+	for _, ipNet := range s.TrustedProxies {
+		if ipNet.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
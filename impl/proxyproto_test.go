@@ -0,0 +1,191 @@
+package impl
+
+import (
+	"bufio"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ajdwfnhaps/easy-tcp-server/iface"
+)
+
+//proxyV2Header 构造PROXY协议v2头部，src为nil时为LOCAL命令
+func proxyV2Header(src, dst *net.TCPAddr) []byte {
+	header := append([]byte{}, proxyV2Signature...)
+	if src == nil {
+		return append(header, 0x20, 0x00, 0x00, 0x00)
+	}
+
+	family, srcIP, dstIP := byte(0x11), src.IP.To4(), dst.IP.To4()
+	if srcIP == nil {
+		family, srcIP, dstIP = 0x21, src.IP.To16(), dst.IP.To16()
+	}
+	body := append(append([]byte{}, srcIP...), dstIP...)
+	body = append(body, 0, 0, 0, 0)
+	binary.BigEndian.PutUint16(body[len(body)-4:], uint16(src.Port))
+	binary.BigEndian.PutUint16(body[len(body)-2:], uint16(dst.Port))
+	//附加一个TLV，解析时应跳过
+	body = append(body, 0x04, 0x00, 0x01, 0xff)
+
+	header = append(header, 0x21, family, 0, 0)
+	binary.BigEndian.PutUint16(header[14:], uint16(len(body)))
+	return append(header, body...)
+}
+
+//startProxyTestServer 启动启用PROXY协议的测试Server，返回连接创建时的连接
+func startProxyTestServer(t *testing.T, trusted ...string) (*Server, chan iface.IConnection) {
+	s := NewServer(WithAddr("127.0.0.1", 0), WithProxyProtocol(trusted...)).(*Server)
+	s.AddRouter("request_echo", &echoRouter{})
+	started := make(chan iface.IConnection, 1)
+	s.SetOnConnStart(func(conn iface.IConnection) {
+		started <- conn
+	})
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return s, started
+}
+
+//dialWithHeader 连接测试Server，发送header及一条echo请求，与header在同一次写入中以验证缓冲数据不丢失
+func dialWithHeader(t *testing.T, s *Server, header []byte) net.Conn {
+	client, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SetDeadline(time.Now().Add(3 * time.Second))
+
+	req := `{"cmd":"request_echo"}`
+	data, _ := s.GetDataPack().Pack(NewMsgPackage([]byte(req)))
+	if _, err := client.Write(append(header, data...)); err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func expectEcho(t *testing.T, s *Server, client net.Conn) {
+	msg, err := readTestMsg(client, s.GetDataPack())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(msg.GetBody()) != `{"cmd":"request_echo"}` {
+		t.Fatalf("unexpected reply %s", msg.GetBody())
+	}
+}
+
+func TestProxyProtocolV1(t *testing.T) {
+	s, started := startProxyTestServer(t)
+	defer s.Stop()
+
+	client := dialWithHeader(t, s, []byte("PROXY TCP4 203.0.113.7 10.0.0.1 56324 8091\r\n"))
+	defer client.Close()
+	expectEcho(t, s, client)
+
+	conn := <-started
+	if conn.RemoteAddr().String() != "203.0.113.7:56324" {
+		t.Fatalf("unexpected remote addr %s", conn.RemoteAddr())
+	}
+	if conn.GetProxyAddr().String() != client.LocalAddr().String() {
+		t.Fatalf("unexpected proxy addr %s", conn.GetProxyAddr())
+	}
+}
+
+func TestProxyProtocolV2(t *testing.T) {
+	s, started := startProxyTestServer(t, "127.0.0.0/8")
+	defer s.Stop()
+
+	src := &net.TCPAddr{IP: net.ParseIP("2001:db8::7"), Port: 40000}
+	dst := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 8091}
+	client := dialWithHeader(t, s, proxyV2Header(src, dst))
+	defer client.Close()
+	expectEcho(t, s, client)
+	if conn := <-started; conn.RemoteAddr().String() != "[2001:db8::7]:40000" {
+		t.Fatalf("unexpected remote addr %s", conn.RemoteAddr())
+	}
+
+	//LOCAL命令为代理自身的连接，使用代理的地址
+	local := dialWithHeader(t, s, proxyV2Header(nil, nil))
+	defer local.Close()
+	expectEcho(t, s, local)
+	if conn := <-started; conn.RemoteAddr().String() != local.LocalAddr().String() {
+		t.Fatalf("unexpected remote addr %s", conn.RemoteAddr())
+	}
+}
+
+func TestProxyProtocolUntrustedPeer(t *testing.T) {
+	s, started := startProxyTestServer(t, "10.0.0.0/8", "192.168.1.1")
+	defer s.Stop()
+
+	//不受信任的对端不解析头部，按普通连接处理
+	client := dialWithHeader(t, s, nil)
+	defer client.Close()
+	expectEcho(t, s, client)
+
+	conn := <-started
+	if conn.RemoteAddr().String() != client.LocalAddr().String() || conn.GetProxyAddr() != nil {
+		t.Fatalf("unexpected addrs %s %v", conn.RemoteAddr(), conn.GetProxyAddr())
+	}
+}
+
+func TestProxyProtocolBadHeader(t *testing.T) {
+	s := NewServer(WithAddr("127.0.0.1", 0), WithProxyProtocol()).(*Server)
+	started := make(chan struct{}, 3)
+	s.SetOnConnStart(func(conn iface.IConnection) {
+		started <- struct{}{}
+	})
+	stopped := make(chan struct{}, 6)
+	s.SetOnConnStop(func(conn iface.IConnection) {
+		stopped <- struct{}{}
+	})
+	s.SetOnConnClosed(func(conn iface.IConnection, reason iface.CloseReason) {
+		stopped <- struct{}{}
+	})
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	for _, header := range []string{
+		"GET / HTTP/1.1\r\n\r\n",
+		"PROXY TCP4 203.0.113.7\r\n",
+		"PROXY TCP4 " + strings.Repeat("1", proxyV1MaxLen) + "\r\n",
+	} {
+		client := dialWithHeader(t, s, []byte(header))
+		if _, err := bufio.NewReader(client).ReadByte(); err == nil {
+			t.Fatalf("conn with header %q should be closed", header)
+		}
+		client.Close()
+	}
+
+	select {
+	case <-started:
+		t.Fatal("OnConnStart must not be called for invalid headers")
+	case <-stopped:
+		t.Fatal("OnConnStop must not be called for conns that never started")
+	default:
+	}
+}
+
+func TestProxyTrustedProxiesConfig(t *testing.T) {
+	nets, err := parseTrustedProxies([]string{"10.0.0.0/8", "192.168.1.1", "::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{TrustedProxies: nets}
+	for addr, want := range map[string]bool{
+		"10.1.2.3":    true,
+		"192.168.1.1": true,
+		"192.168.1.2": false,
+		"::1":         true,
+		"127.0.0.1":   false,
+	} {
+		if got := s.isTrustedProxy(&net.TCPAddr{IP: net.ParseIP(addr)}); got != want {
+			t.Fatalf("isTrustedProxy(%s) = %v, want %v", addr, got, want)
+		}
+	}
+
+	if _, err := parseTrustedProxies([]string{"10.0.0.0/33"}); err == nil {
+		t.Fatal("expected error for invalid cidr")
+	}
+}
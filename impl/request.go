@@ -1,6 +1,8 @@
 package impl
 
 import (
+	"context"
+
 	"github.com/ajdwfnhaps/easy-tcp-server/dto"
 	"github.com/ajdwfnhaps/easy-tcp-server/iface"
 )
@@ -9,6 +11,7 @@ type Request struct {
 	conn iface.IConnection //已经和客户端建立好的 链接
 	msg  iface.IMessage    //客户端请求的数据
 	ret  dto.Result        //反序列化的结果
+	ctx  context.Context   //请求的Context，为nil时使用连接的Context
 }
 
 //获取请求连接信息
@@ -28,3 +31,21 @@ func (r *Request) GetRet() dto.Result {
 func (r *Request) GetRouterCmd() string {
 	return r.ret.Cmd
 }
+
+//Context 获取请求的Context，连接关闭或超过路由的超时时间时取消
+func (r *Request) Context() context.Context {
+	if r.ctx != nil {
+		return r.ctx
+	}
+	if r.conn != nil {
+		return r.conn.Context()
+	}
+	return context.Background()
+}
+
+//WithContext 返回使用ctx的请求副本
+func (r *Request) WithContext(ctx context.Context) *Request {
+	r2 := *r
+	r2.ctx = ctx
+	return &r2
+}
@@ -0,0 +1,81 @@
+package impl
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/ajdwfnhaps/easy-tcp-server/dto"
+	"github.com/ajdwfnhaps/easy-tcp-server/iface"
+)
+
+var (
+	//ErrInternal 处理请求时发生panic，回复客户端的错误
+	ErrInternal = errors.New("internal server error")
+	//ErrHandlerTimeout 处理请求超过路由的超时时间，回复客户端的错误
+	ErrHandlerTimeout = errors.New("handler timeout")
+)
+
+//DefaultResponseEncoder 默认的响应编码方法，将响应结果编码为JSON
+func DefaultResponseEncoder(ret dto.Result) ([]byte, error) {
+	return json.Marshal(ret)
+}
+
+//DefaultNotFoundHandler 默认的找不到路由的响应结果
+func DefaultNotFoundHandler(request iface.IRequest) dto.Result {
+	return dto.Result{
+		Status: -1,
+		Cmd:    "unkown-action",
+		Msg:    "handler cmd = " + request.GetRouterCmd() + " is not FOUND!",
+	}
+}
+
+//DefaultErrorHandler 默认的错误响应结果，原样返回请求的cmd和seqno
+func DefaultErrorHandler(request iface.IRequest, err error) dto.Result {
+	ret := request.GetRet()
+	return dto.Result{
+		Status: -1,
+		Cmd:    ret.Cmd,
+		Seqno:  ret.Seqno,
+		Msg:    err.Error(),
+	}
+}
+
+//reply 使用响应编码方法编码响应结果并发送给客户端
+func (mh *MsgHandle) reply(request iface.IRequest, ret dto.Result) {
+	data, err := mh.ResponseEncoder(ret)
+	if err != nil {
+		mh.cfg.Logger.Errorf("响应结果编码出错，cmd:%s，%s", ret.Cmd, err.Error())
+		return
+	}
+	if err := request.GetConnection().SendMsg(data); err != nil {
+		mh.cfg.Logger.Errorf("回复客户端[%s]出错，cmd:%s，%s", request.GetConnection().RemoteAddr(), ret.Cmd, err.Error())
+	}
+}
+
+//replyNotFound 找不到路由时回复客户端
+func (mh *MsgHandle) replyNotFound(request iface.IRequest) error {
+	mh.cfg.Logger.Error("handler cmd = ", request.GetRouterCmd(), " is not FOUND!")
+	mh.reply(request, mh.NotFoundHandler(request))
+	return nil
+}
+
+//errorResult 处理请求出错时回复客户端的响应结果
+func (mh *MsgHandle) errorResult(request iface.IRequest, err error) dto.Result {
+	mh.cfg.Logger.Errorf("DoMsgHandler Err: %s", err.Error())
+	return mh.ErrorHandler(request, err)
+}
+
+//SetResponseEncoder 设置响应编码方法
+func (mh *MsgHandle) SetResponseEncoder(encoder iface.ResponseEncoder) {
+	mh.ResponseEncoder = encoder
+}
+
+//SetNotFoundHandler 设置找不到路由时的响应方法
+func (mh *MsgHandle) SetNotFoundHandler(handler iface.NotFoundHandler) {
+	mh.NotFoundHandler = handler
+}
+
+//SetErrorHandler 设置处理请求出错时的响应方法
+func (mh *MsgHandle) SetErrorHandler(handler iface.ErrorHandler) {
+	mh.ErrorHandler = handler
+}
@@ -21,3 +21,38 @@ func (br *BaseRouter) Handle(req iface.IRequest) error {
 
 //PostHandle PostHandle
 func (br *BaseRouter) PostHandle(req iface.IRequest) {}
+
+//RouterGroup 路由分组，组内路由共享该组及其上级分组的中间件
+type RouterGroup struct {
+	msgHandler  *MsgHandle
+	parent      *RouterGroup
+	middlewares []iface.Middleware
+}
+
+//Use 为该组添加中间件，对组内已注册及之后注册的路由都生效
+func (g *RouterGroup) Use(middlewares ...iface.Middleware) {
+	g.middlewares = append(g.middlewares, middlewares...)
+}
+
+//Group 创建子分组，子分组的中间件在该组的中间件之后执行
+func (g *RouterGroup) Group(middlewares ...iface.Middleware) iface.IRouterGroup {
+	return &RouterGroup{
+		msgHandler:  g.msgHandler,
+		parent:      g,
+		middlewares: middlewares,
+	}
+}
+
+//AddRouter 在该组中注册路由
+func (g *RouterGroup) AddRouter(cmd string, router iface.IRouter) {
+	g.msgHandler.AddRouter(cmd, router)
+	g.msgHandler.groups[cmd] = g
+}
+
+//chain 获取从最上级分组到该组的全部中间件
+func (g *RouterGroup) chain() []iface.Middleware {
+	if g.parent == nil {
+		return g.middlewares
+	}
+	return append(append([]iface.Middleware{}, g.parent.chain()...), g.middlewares...)
+}
@@ -1,8 +1,14 @@
 package impl
 
 import (
-	"fmt"
+	"context"
+	"crypto/tls"
+	"errors"
 	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/ajdwfnhaps/easy-tcp-server/iface"
 	"github.com/ajdwfnhaps/easy-tcp-server/utils"
@@ -13,12 +19,18 @@ import (
 type Server struct {
 	//服务器的名称
 	Name string
-	//tcp4 or other
+	//监听的网络类型，tcp或unix
+	Network string
+	//监听的TCP网络类型：tcp(IPv4及IPv6双栈)、tcp4或tcp6
 	IPVersion string
 	//服务绑定的IP地址
 	IP string
 	//服务绑定的端口
 	Port int
+	//Network为unix时监听的socket文件路径
+	Address string
+	//Unix socket文件的权限，0时使用系统默认
+	UnixSocketMode os.FileMode
 	//当前Server的消息管理模块，用来绑定MsgId和对应的处理方法
 	msgHandler iface.IMsgHandle
 	//当前Server的链接管理器
@@ -27,118 +39,492 @@ type Server struct {
 	OnConnStart func(conn iface.IConnection)
 	//该Server的连接断开时的Hook函数
 	OnConnStop func(conn iface.IConnection)
+	//该Server的连接断开时携带关闭原因的Hook函数
+	OnConnClosed func(conn iface.IConnection, reason iface.CloseReason)
+	//该Server拒绝接入连接时的Hook函数
+	OnConnRejected func(addr net.Addr, reason error)
 	//该Server成功启动后的Hook函数
 	OnServerStarted func(s iface.IServer)
 	//日志
 	Logger logger.ILogger
 	//广播消息channel
 	bcChan chan []byte
+	//封包拆包实例，连接的Reader、Writer及广播统一使用
+	dataPack iface.IDataPack
+	//读空闲超时，超过该时长未收到客户端数据则关闭连接，0为不检测
+	ReadIdleTimeout time.Duration
+	//服务端心跳间隔，连接空闲超过该时长时向客户端发送心跳，0为不发送
+	HeartbeatInterval time.Duration
+	//生成服务端心跳消息的方法
+	HeartbeatMsgFunc func(conn iface.IConnection) []byte
+	//TLS配置，为nil且未配置证书路径时使用明文TCP
+	TLSConfig *tls.Config
+	//受信任的PROXY协议代理网段，为空时信任所有对端
+	TrustedProxies []*net.IPNet
+	//连接ID生成器
+	ConnIDGenerator iface.IConnIDGenerator
+	//连接发送队列已满时的背压策略，对之后建立的连接生效
+	SendPolicy iface.SendPolicy
+
+	//额外监听的地址，与Server自身的地址共享路由、连接管理及广播
+	ListenerConfigs []utils.ListenerConfig
+
+	//当前监听器，第一个为Server自身的地址
+	listeners []*listener
+	//接入速率及每个客户端IP的连接数限制，未配置时为nil
+	limiter *connLimiter
+	//是否正在关闭，原子操作
+	inShutdown int32
+	//服务关闭时close，通知Serve及广播处理器退出
+	doneChan chan struct{}
+	//保证doneChan只关闭一次
+	doneOnce sync.Once
+	//保护listeners的锁
+	mu sync.Mutex
+	//等待acceptLoop退出，此后不会再有新的连接加入ConnMgr
+	acceptWg sync.WaitGroup
+	//当前Server的配置
+	cfg *utils.GlobalObj
+}
+
+var (
+	//ErrServerClosed 服务已经关闭，ListenAndServe在Stop或Shutdown之后返回该错误
+	ErrServerClosed = errors.New("iot tcp server closed")
+	//ErrServerStarted 服务已经启动，重复调用Start时返回该错误
+	ErrServerStarted = errors.New("iot tcp server already started")
+)
+
+//shutdownPollInterval 优雅关闭时轮询检查的间隔
+const shutdownPollInterval = 10 * time.Millisecond
+
+//configProvider 提供所属Server配置的对象
+type configProvider interface {
+	config() *utils.GlobalObj
+}
+
+//drainer 支持优雅关闭的连接
+type drainer interface {
+	//停止读取客户端新的请求
+	stopReading()
+	//等待正在读取的请求交给MsgHandler
+	waitReading(ctx context.Context) error
+	//发送完写缓冲中的消息后关闭连接
+	flushAndStop(ctx context.Context) error
 }
 
 // NewServer 创建一个服务器句柄
-func NewServer() iface.IServer {
+//未传入选项时直接使用全局默认配置utils.GlobalObject；传入选项时在utils.GlobalObject的副本上应用选项，不影响全局配置
+func NewServer(opts ...Option) iface.IServer {
+	if len(opts) == 0 {
+		return NewServerWithConfig(utils.GlobalObject)
+	}
+
+	cfg := *utils.GlobalObject
+	cfg.TcpServer = nil
+	o := &options{cfg: &cfg}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	s := NewServerWithConfig(o.cfg).(*Server)
+	if o.dataPack != nil {
+		s.dataPack = o.dataPack
+	}
+	if o.tlsConfig != nil {
+		s.TLSConfig = o.tlsConfig
+	}
+	if o.connIDGenerator != nil {
+		s.ConnIDGenerator = o.connIDGenerator
+	}
+	if o.unixSocketMode != 0 {
+		s.UnixSocketMode = o.unixSocketMode
+	}
+	s.ListenerConfigs = append(s.ListenerConfigs, o.listeners...)
+	if o.sendPolicy != nil {
+		s.SendPolicy = *o.sendPolicy
+	}
+	return s
+}
+
+//NewServerWithConfig 使用指定配置创建一个服务器句柄，配置会传递给连接、消息管理及连接管理模块，
+//同一进程中的多个Server应各自使用独立的配置(utils.NewConfig或utils.LoadConfig)
+func NewServerWithConfig(cfg *utils.GlobalObj) iface.IServer {
+	if cfg.Logger == nil {
+		cfg.Logger = &logger.Logger{}
+	}
+	if cfg.IPVersion == "" {
+		cfg.IPVersion = DefaultIPVersion
+	}
 
 	s := &Server{
-		Name:       utils.GlobalObject.Name,
-		IPVersion:  "tcp4",
-		IP:         utils.GlobalObject.Host,
-		Port:       utils.GlobalObject.TcpPort,
-		msgHandler: NewMsgHandle(),
-		ConnMgr:    NewConnManager(),
+		Name:       cfg.Name,
+		Network:    cfg.Network,
+		IPVersion:  cfg.IPVersion,
+		IP:         cfg.Host,
+		Port:       cfg.TcpPort,
+		Address:    cfg.Address,
+		msgHandler: newMsgHandle(cfg),
+		ConnMgr:    newConnManager(cfg),
 		bcChan:     make(chan []byte),
+		dataPack:   newDataPack(cfg.MaxPacketSize),
+		doneChan:   make(chan struct{}),
+		Logger:     cfg.Logger,
+		cfg:        cfg,
+		limiter:    newConnLimiter(cfg),
+
+		ReadIdleTimeout:   time.Duration(cfg.ReadIdleTimeout) * time.Second,
+		HeartbeatInterval: time.Duration(cfg.HeartbeatInterval) * time.Second,
+		HeartbeatMsgFunc:  DefaultHeartbeatMsg,
+		ConnIDGenerator:   &AtomicConnIDGenerator{},
+		SendPolicy: iface.SendPolicy{
+			Timeout: time.Duration(cfg.SendTimeoutMs) * time.Millisecond,
+		},
+
+		ListenerConfigs: append([]utils.ListenerConfig(nil), cfg.Listeners...),
+	}
+	if cfg.SendOverflowPolicy != "" {
+		//无效的策略在Start时返回错误
+		s.SendPolicy.Overflow, _ = ParseOverflowPolicy(cfg.SendOverflowPolicy)
 	}
 	return s
 }
 
 //============== 实现 iface.IServer 里的全部接口方法 ========
 
-//Start 开启网络服务
-func (s *Server) Start() {
+//Start 开启网络服务：同步绑定监听地址，绑定失败时返回错误，成功后在后台接收客户端连接
+func (s *Server) Start() error {
 	s.Logger.Printf("IOT Tcp Server : %s , listen at IP: %s, Port %d is starting\n", s.Name, s.IP, s.Port)
 
-	//开启一个go去做服务端Linster业务
-	go func() {
-		//0 启动worker工作池机制
-		s.msgHandler.StartWorkerPool()
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-		//1 获取一个TCP的Addr
-		addr, err := net.ResolveTCPAddr(s.IPVersion, fmt.Sprintf("%s:%d", s.IP, s.Port))
+	if s.shuttingDown() {
+		return ErrServerClosed
+	}
+	if s.listeners != nil {
+		return ErrServerStarted
+	}
+
+	//0 配置了证书路径时加载TLS配置
+	if s.TLSConfig == nil && s.cfg.TLSCertFile != "" {
+		tlsConfig, err := loadTLSConfig(s.cfg.TLSCertFile, s.cfg.TLSKeyFile, s.cfg.TLSClientCAFile)
 		if err != nil {
-			s.Logger.Errorf("resolve tcp addr err: ", err)
-			return
+			s.Logger.Errorf("load tls config err: %s", err)
+			return err
 		}
+		s.TLSConfig = tlsConfig
+	}
 
-		//2 监听服务器地址
-		listenner, err := net.ListenTCP(s.IPVersion, addr)
+	//0 检查发送队列已满时的处理策略
+	if s.cfg.SendOverflowPolicy != "" {
+		if _, err := ParseOverflowPolicy(s.cfg.SendOverflowPolicy); err != nil {
+			s.Logger.Errorf("parse send overflow policy err: %s", err)
+			return err
+		}
+	}
+
+	//0 解析受信任的PROXY协议代理
+	if s.TrustedProxies == nil && len(s.cfg.TrustedProxies) > 0 {
+		trusted, err := parseTrustedProxies(s.cfg.TrustedProxies)
 		if err != nil {
-			s.Logger.Errorf("listen", s.IPVersion, "err", err)
-			return
+			s.Logger.Errorf("parse trusted proxies err: %s", err)
+			return err
 		}
+		s.TrustedProxies = trusted
+	}
 
-		//已经监听成功
-		s.Logger.Info("start iot tcp server  ", s.Name, " succ, now listenning...")
-
-		//开启广播处理器
-		go s.handleBroadcast()
-		//TODO server.go 应该有一个自动生成ID的方法
-		var cid uint32
-		cid = 0
-
-		//3 启动server网络连接业务
-		for {
-			//3.1 阻塞等待客户端建立连接请求
-			conn, err := listenner.AcceptTCP()
-			if err != nil {
-				s.Logger.Errorf("Accept err ", err)
-				continue
+	//1 监听服务器地址及额外配置的地址，任一失败时关闭已监听的地址
+	listenner, err := s.listenDefault()
+	if err != nil {
+		s.Logger.Errorf("listen %s err: %s", s.Network, err)
+		return err
+	}
+	listeners := []*listener{listenner}
+	for _, lc := range s.ListenerConfigs {
+		l, err := s.listenConfig(lc)
+		if err != nil {
+			s.Logger.Errorf("listen %s %s err: %s", lc.Network, lc.Address, err)
+			for _, l := range listeners {
+				l.ln.Close()
 			}
-			s.Logger.Info("新的tcp客户端连接已创建, conn remote addr = ", conn.RemoteAddr().String())
+			return err
+		}
+		listeners = append(listeners, l)
+	}
+	s.listeners = listeners
+
+	//已经监听成功
+	for _, l := range listeners {
+		s.Logger.Info("start iot tcp server  ", s.Name, " succ, now listenning at ", l.Addr(), " [", l.Name(), "]")
+	}
+
+	//3 启动worker工作池机制
+	s.msgHandler.StartWorkerPool()
+	//开启广播处理器
+	go s.handleBroadcast()
+	//开启心跳检测
+	go s.startHeartbeat()
+	//4 每个监听器开启一个go去做服务端Linster业务
+	s.acceptWg.Add(len(listeners))
+	for _, l := range listeners {
+		go s.acceptLoop(l)
+	}
 
-			//3.2 设置服务器最大连接控制,如果超过最大连接，那么则关闭此新的连接
-			if s.ConnMgr.Len() >= utils.GlobalObject.MaxConn {
-				s.Logger.Warnf("tcp连接数已超出配置上限：%d,将会关闭连接", utils.GlobalObject.MaxConn)
-				conn.Close()
-				continue
+	return nil
+}
+
+//acceptLoop 阻塞等待客户端建立连接请求，直到监听器被关闭
+func (s *Server) acceptLoop(listenner *listener) {
+	defer s.acceptWg.Done()
+	for {
+		//阻塞等待客户端建立连接请求
+		conn, err := listenner.ln.Accept()
+		if err != nil {
+			if s.shuttingDown() {
+				s.Logger.Info("iot tcp server listener ", listenner.Name(), " closed, stop accepting")
+				return
 			}
+			s.Logger.Errorf("Accept err %s", err)
+			continue
+		}
+		s.serveConn(conn, listenner)
+	}
+}
 
-			//3.3 处理该新连接请求的 业务 方法， 此时应该有 handler 和 conn是绑定的
-			dealConn := NewConntion(s, conn, cid, s.msgHandler)
+//ServeConn 使用已建立的连接提供服务，可用于net.Pipe或自定义传输，配置了TLS时同样先进行握手
+func (s *Server) ServeConn(conn net.Conn) {
+	s.serveConn(conn, &listener{tlsConfig: s.TLSConfig})
+}
 
-			// var cidLock sync.RWMutex
-			// cidLock.Lock()
-			cid++
-			// cidLock.Unlock()
+//serveConn 处理从监听器l接入的连接，l的TLS配置及连接数限制只作用于该监听器的连接
+func (s *Server) serveConn(conn net.Conn, l *listener) {
+	if s.shuttingDown() {
+		conn.Close()
+		return
+	}
 
-			//3.4 启动当前链接的处理业务
-			go dealConn.Start()
+	//1 检查连接数及接入速率限制，超过限制时关闭此新的连接
+	if err := s.admit(conn, l); err != nil {
+		s.rejectConn(conn, err)
+		return
+	}
+	//经过PROXY协议代理的连接在读取头部后按真实的客户端IP限制
+	proxied := l.proxyProtocol && s.isTrustedProxy(conn.RemoteAddr())
+	var releaseIP func()
+	if !proxied {
+		release, err := s.admitIP(conn.RemoteAddr())
+		if err != nil {
+			s.rejectConn(conn, err)
+			return
 		}
-	}()
+		releaseIP = release
+	}
+	s.Logger.Info("新的tcp客户端连接已创建, conn remote addr = ", conn.RemoteAddr().String())
+
+	//2 底层为TCP连接时按配置调整TCP参数
+	if tcpConn, ok := conn.(iface.ITCPConn); ok {
+		s.tuneTCPConn(tcpConn)
+	}
+
+	//3 处理该新连接请求的 业务 方法， 此时应该有 handler 和 conn是绑定的
+	//受信任代理的连接先经过PROXY协议解析，再进行TLS握手
+	var rw net.Conn = conn
+	var proxy *proxyConn
+	if proxied {
+		proxy = newProxyConn(conn)
+		rw = proxy
+	}
+	if l.tlsConfig != nil {
+		rw = tls.Server(rw, l.tlsConfig)
+	}
+	cid := s.ConnIDGenerator.NextID(s.connIDInUse)
+	dealConn := newConnection(s, conn, rw, cid, s.msgHandler)
+	dealConn.proxy = proxy
+	dealConn.releaseIP = releaseIP
+	if l.ln != nil {
+		dealConn.listener = l
+	}
+	atomic.AddInt64(&l.conns, 1)
+	//将新创建的Conn添加到链接管理中，此后Stop、ClearConn及心跳检测都可能关闭该连接
+	s.ConnMgr.Add(dealConn)
+
+	//4 启动当前链接的处理业务
+	go dealConn.Start()
+}
+
+//sendPolicy 连接发送队列已满时的背压策略
+func (s *Server) sendPolicy() iface.SendPolicy {
+	return s.SendPolicy
 }
 
-//Stop 停止服务
+//connIDInUse 判断连接ID是否仍被存活的连接使用
+func (s *Server) connIDInUse(connID uint32) bool {
+	_, err := s.ConnMgr.Get(connID)
+	return err == nil
+}
+
+//tuneTCPConn 按配置调整TCP参数，未配置的参数保持系统默认值
+func (s *Server) tuneTCPConn(conn iface.ITCPConn) {
+	if s.cfg.TCPKeepAlive > 0 {
+		conn.SetKeepAlive(true)
+		conn.SetKeepAlivePeriod(time.Duration(s.cfg.TCPKeepAlive) * time.Second)
+	}
+	if s.cfg.TCPReadBuffer > 0 {
+		if err := conn.SetReadBuffer(s.cfg.TCPReadBuffer); err != nil {
+			s.Logger.Warnf("set tcp read buffer err: %s", err)
+		}
+	}
+	if s.cfg.TCPWriteBuffer > 0 {
+		if err := conn.SetWriteBuffer(s.cfg.TCPWriteBuffer); err != nil {
+			s.Logger.Warnf("set tcp write buffer err: %s", err)
+		}
+	}
+}
+
+//Stop 立即停止服务，不等待正在处理的请求
 func (s *Server) Stop() {
+	atomic.StoreInt32(&s.inShutdown, 1)
+	s.closeListener()
 	//将其他需要清理的连接信息或者其他信息 也要一并停止或者清理
 	s.ConnMgr.ClearConn()
-	close(s.bcChan)
+	s.msgHandler.Stop()
+	s.closeDone()
 	s.Logger.Info("iot tcp server has been stoped")
 }
 
-//Serve 运行服务
-func (s *Server) Serve() {
+//Shutdown 优雅停止服务：停止接收新连接，等待worker处理完已入队的请求，
+//发送完各连接写缓冲中的消息后再关闭连接。ctx超时则强制关闭剩余连接并返回ctx的错误
+func (s *Server) Shutdown(ctx context.Context) error {
+	if !atomic.CompareAndSwapInt32(&s.inShutdown, 0, 1) {
+		return nil
+	}
+	defer s.closeDone()
+	s.Logger.Info("iot tcp server is shutting down...")
+
+	//1 关闭监听器，停止接收新连接，等待正在接入的连接加入ConnMgr
+	s.closeListener()
+	s.acceptWg.Wait()
+
+	//2 停止读取客户端新的请求，等待各Reader将已读取的请求入队
+	conns := s.ConnMgr.GetAll()
+	for _, conn := range conns {
+		if d, ok := conn.(drainer); ok {
+			d.stopReading()
+		}
+	}
+	for _, conn := range conns {
+		if d, ok := conn.(drainer); ok {
+			if err := d.waitReading(ctx); err != nil {
+				s.Logger.Warn("等待停止读取超时，强制关闭所有连接: ", err)
+				s.ConnMgr.ClearConn()
+				return err
+			}
+		}
+	}
+
+	//3 等待worker处理完已入队的请求
+	if err := s.msgHandler.Shutdown(ctx); err != nil {
+		s.Logger.Warn("等待请求处理完成超时，强制关闭所有连接: ", err)
+		s.ConnMgr.ClearConn()
+		return err
+	}
+
+	//4 发送完写缓冲中的消息后关闭连接
+	var wg sync.WaitGroup
+	errChan := make(chan error, len(conns))
+	for _, conn := range conns {
+		d, ok := conn.(drainer)
+		if !ok {
+			conn.Stop()
+			continue
+		}
+		wg.Add(1)
+		go func(d drainer) {
+			defer wg.Done()
+			if err := d.flushAndStop(ctx); err != nil {
+				errChan <- err
+			}
+		}(d)
+	}
+	wg.Wait()
+	close(errChan)
+	//关闭通过ServeConn等方式在快照之后加入的连接
+	s.ConnMgr.ClearConn()
 
-	if s.Logger == nil {
-		s.Logger = &logger.Logger{}
+	if err := <-errChan; err != nil {
+		s.Logger.Warn("发送缓冲消息超时，已强制关闭剩余连接: ", err)
+		return err
 	}
 
-	utils.GlobalObject.Logger = s.Logger
+	s.Logger.Info("iot tcp server has been shutdown gracefully")
+	return nil
+}
+
+//shuttingDown 服务是否正在关闭
+func (s *Server) shuttingDown() bool {
+	return atomic.LoadInt32(&s.inShutdown) != 0
+}
+
+//closeListener 关闭全部监听器
+func (s *Server) closeListener() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	s.Start()
-	utils.GlobalObject.TcpServer = s
+	for _, l := range s.listeners {
+		l.ln.Close()
+	}
+	s.listeners = nil
+}
+
+//closeDone 通知Serve及广播处理器退出
+func (s *Server) closeDone() {
+	s.doneOnce.Do(func() {
+		close(s.doneChan)
+	})
+}
+
+//ListenAndServe 绑定监听地址并运行服务，阻塞直到服务关闭。
+//绑定失败时立即返回错误，Stop或Shutdown之后返回ErrServerClosed
+func (s *Server) ListenAndServe() error {
+	if err := s.Start(); err != nil {
+		return err
+	}
+
+	s.cfg.TcpServer = s
 	s.CallOnServerStarted(s)
 	//TODO Server.Serve() 是否在启动服务的时候 还要处理其他的事情呢 可以在这里添加
 
-	//阻塞,否则主Go退出， listenner的go将会退出
-	select {}
+	//阻塞直到服务关闭,否则主Go退出， listenner的go将会退出
+	<-s.doneChan
+	return ErrServerClosed
+}
+
+//Serve 运行服务，同ListenAndServe
+func (s *Server) Serve() error {
+	return s.ListenAndServe()
+}
+
+//Listeners 获取全部监听器，第一个为Server自身的地址，未启动时返回nil
+func (s *Server) Listeners() []iface.IListener {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var listeners []iface.IListener
+	for _, l := range s.listeners {
+		listeners = append(listeners, l)
+	}
+	return listeners
+}
+
+//Addr 获取服务实际监听的地址，未启动时返回nil
+func (s *Server) Addr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.listeners) == 0 {
+		return nil
+	}
+	return s.listeners[0].Addr()
 }
 
 //AddRouter 路由功能：给当前服务注册一个路由业务方法，供客户端链接处理使用
@@ -146,6 +532,16 @@ func (s *Server) AddRouter(cmd string, router iface.IRouter) {
 	s.msgHandler.AddRouter(cmd, router)
 }
 
+//Use 添加全局中间件，按添加顺序由外到内包装所有请求的处理
+func (s *Server) Use(middlewares ...iface.Middleware) {
+	s.msgHandler.Use(middlewares...)
+}
+
+//Group 创建路由分组，组内路由共享该组的中间件
+func (s *Server) Group(middlewares ...iface.Middleware) iface.IRouterGroup {
+	return s.msgHandler.Group(middlewares...)
+}
+
 //GetConnMgr 得到链接管理
 func (s *Server) GetConnMgr() iface.IConnManager {
 	return s.ConnMgr
@@ -156,11 +552,16 @@ func (s *Server) SetOnConnStart(hookFunc func(iface.IConnection)) {
 	s.OnConnStart = hookFunc
 }
 
-//SetOnConnStop 设置该Server的连接断开时的Hook函数
+//SetOnConnStop 设置该Server的连接断开时的Hook函数，TLS握手失败等未启动的连接不调用
 func (s *Server) SetOnConnStop(hookFunc func(iface.IConnection)) {
 	s.OnConnStop = hookFunc
 }
 
+//SetOnConnClosed 设置该Server的连接断开时携带关闭原因的Hook函数，在OnConnStop之后调用
+func (s *Server) SetOnConnClosed(hookFunc func(conn iface.IConnection, reason iface.CloseReason)) {
+	s.OnConnClosed = hookFunc
+}
+
 //CallOnConnStart 调用连接OnConnStart Hook函数
 func (s *Server) CallOnConnStart(conn iface.IConnection) {
 	if s.OnConnStart != nil {
@@ -169,12 +570,27 @@ func (s *Server) CallOnConnStart(conn iface.IConnection) {
 	}
 }
 
-//CallOnConnStop 调用连接OnConnStop Hook函数
+//CallOnConnStop 调用连接OnConnStop及OnConnClosed Hook函数
 func (s *Server) CallOnConnStop(conn iface.IConnection) {
 	if s.OnConnStop != nil {
 		s.Logger.Info("---> CallOnConnStop....")
 		s.OnConnStop(conn)
 	}
+	if s.OnConnClosed != nil {
+		s.OnConnClosed(conn, conn.CloseReason())
+	}
+}
+
+//SetOnConnRejected 设置该Server拒绝接入连接时的Hook函数，reason为ErrMaxConnPerIP、ErrAcceptRate等拒绝原因
+func (s *Server) SetOnConnRejected(hookFunc func(addr net.Addr, reason error)) {
+	s.OnConnRejected = hookFunc
+}
+
+//CallOnConnRejected 调用OnConnRejected Hook函数
+func (s *Server) CallOnConnRejected(addr net.Addr, reason error) {
+	if s.OnConnRejected != nil {
+		s.OnConnRejected(addr, reason)
+	}
 }
 
 //SetOnServerStarted 设置该Server成功启动后Hook函数
@@ -192,18 +608,73 @@ func (s *Server) CallOnServerStarted(svr iface.IServer) {
 
 // SetLogger 设置日志框架
 func (s *Server) SetLogger(logger logger.ILogger) {
-	utils.GlobalObject.Logger = logger
+	s.cfg.Logger = logger
 	s.Logger = logger
 }
 
+//config 获取当前Server的配置
+func (s *Server) config() *utils.GlobalObj {
+	return s.cfg
+}
+
 //GetLogger 获取日志框架
 func (s *Server) GetLogger() logger.ILogger {
 	return s.Logger
 }
 
+//SetOnPanic 设置处理请求发生panic时的Hook函数
+func (s *Server) SetOnPanic(hookFunc func(request iface.IRequest, err interface{})) {
+	s.msgHandler.SetOnPanic(hookFunc)
+}
+
+//SetResponseEncoder 设置错误响应的编码方法
+func (s *Server) SetResponseEncoder(encoder iface.ResponseEncoder) {
+	s.msgHandler.SetResponseEncoder(encoder)
+}
+
+//SetNotFoundHandler 设置找不到路由时的响应方法
+func (s *Server) SetNotFoundHandler(handler iface.NotFoundHandler) {
+	s.msgHandler.SetNotFoundHandler(handler)
+}
+
+//SetErrorHandler 设置处理请求出错时的响应方法
+func (s *Server) SetErrorHandler(handler iface.ErrorHandler) {
+	s.msgHandler.SetErrorHandler(handler)
+}
+
+//SetRouteTimeout 设置路由的超时时间，从开始处理请求时计时，作为请求Context的截止时间，
+//超时后回复ErrHandlerTimeout的错误响应并释放worker；0时使用默认超时时间handler_timeout_ms，小于0为不限制
+func (s *Server) SetRouteTimeout(cmd string, timeout time.Duration) {
+	s.msgHandler.SetRouteTimeout(cmd, timeout)
+}
+
+//SetOnHandlerTimeout 设置处理请求超时时的Hook函数，可用于记录慢请求的指标
+func (s *Server) SetOnHandlerTimeout(hookFunc func(request iface.IRequest, timeout time.Duration)) {
+	s.msgHandler.SetOnHandlerTimeout(hookFunc)
+}
+
+//SetHeartbeatMsgFunc 设置生成服务端心跳消息的方法
+func (s *Server) SetHeartbeatMsgFunc(f func(conn iface.IConnection) []byte) {
+	s.HeartbeatMsgFunc = f
+}
+
+//SetDataPack 设置封包拆包实例，对之后建立的连接生效
+func (s *Server) SetDataPack(dp iface.IDataPack) {
+	s.dataPack = dp
+}
+
+//GetDataPack 获取封包拆包实例
+func (s *Server) GetDataPack() iface.IDataPack {
+	return s.dataPack
+}
+
 //Broadcast 广播
 func (s *Server) Broadcast(data []byte) {
-	s.bcChan <- data
+	select {
+	case s.bcChan <- data:
+	case <-s.doneChan:
+		s.Logger.Warn("iot tcp server已关闭，忽略广播消息")
+	}
 }
 
 //handleBroadcast 广播处理器
@@ -232,6 +703,9 @@ func (s *Server) handleBroadcast() {
 				}
 			}
 			s.Logger.Infof("广播成功数量：%d, 总客户端连接数：%d", i, connCount)
+		case <-s.doneChan:
+			s.Logger.Debug("广播处理器已退出")
+			return
 		}
 	}
 }
@@ -2,18 +2,26 @@ package impl
 
 import (
 	"bufio"
-	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"reflect"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/ajdwfnhaps/easy-logrus/logger"
 	"github.com/ajdwfnhaps/easy-tcp-server/dto"
 	"github.com/ajdwfnhaps/easy-tcp-server/iface"
+	"github.com/ajdwfnhaps/easy-tcp-server/utils"
 )
 
 func TestTagHandler(t *testing.T) {
@@ -85,6 +93,7 @@ func send(msg string) {
 		fmt.Println("client start err, exit!")
 		return
 	}
+	reader := bufio.NewReader(conn)
 
 	for {
 		//request_mid request_heartbeat
@@ -104,41 +113,12 @@ func send(msg string) {
 			return
 		}
 
-		reader := bufio.NewReader(conn)
-		bodySizeBytes, _ := reader.Peek(4)
-
-		bodySizeBuff := bytes.NewBuffer(bodySizeBytes)
-		var bodySize uint32
-		err = binary.Read(bodySizeBuff, binary.LittleEndian, &bodySize)
-		if err != nil {
-			if err == io.EOF {
-				fmt.Println("binary.Read error.跳出循环", err)
-				break // 跳出循环
-			} else {
-				fmt.Println("binary.Read error.", err)
-				continue
-			}
-		}
-		pkgLength := bodySize + dataPacker.GetHeadLen() //包头长度24
-
-		// Buffered返回缓冲中现有的可读取的字节数。
-		if uint32(reader.Buffered()) < pkgLength {
-			fmt.Println("binary.Read 读取完整包失败", reader.Buffered(), pkgLength)
-			continue
-		}
-
 		conn.SetReadDeadline(time.Now().Add(time.Duration(10) * time.Second))
 
-		recdata := make([]byte, pkgLength)
-		if _, err := io.ReadFull(reader, recdata); err != nil {
-			fmt.Println("read msg data error ", err)
-			break
-		}
-
-		//拆包
-		recMsg, err := dataPacker.Unpack(recdata)
+		//读取并拆包
+		recMsg, err := dataPacker.Decode(reader)
 		if err != nil {
-			fmt.Println("unpack error ", err)
+			fmt.Println("decode msg error ", err)
 			break
 		}
 
@@ -177,44 +157,16 @@ func clientRec(name string) {
 
 	fmt.Printf("client %s started\r\n", name)
 
-	for {
-		reader := bufio.NewReader(conn)
-		bodySizeBytes, _ := reader.Peek(4)
-
-		bodySizeBuff := bytes.NewBuffer(bodySizeBytes)
-		var bodySize uint32
-		err = binary.Read(bodySizeBuff, binary.LittleEndian, &bodySize)
-		if err != nil {
-			if err == io.EOF {
-				fmt.Println("binary.Read error.跳出循环", err)
-				break // 跳出循环
-			} else {
-				fmt.Println("binary.Read error.", err)
-				continue
-			}
-		}
-
-		dataPacker := NewDataPack()
-		pkgLength := bodySize + dataPacker.GetHeadLen() //包头长度24
-
-		// Buffered返回缓冲中现有的可读取的字节数。
-		if uint32(reader.Buffered()) < pkgLength {
-			fmt.Println("binary.Read 读取完整包失败", reader.Buffered(), pkgLength)
-			continue
-		}
+	reader := bufio.NewReader(conn)
+	dataPacker := NewDataPack()
 
+	for {
 		//conn.SetReadDeadline(time.Now().Add(time.Duration(10) * time.Second))
 
-		recdata := make([]byte, pkgLength)
-		if _, err := io.ReadFull(reader, recdata); err != nil {
-			fmt.Println("read msg data error ", err)
-			break
-		}
-
-		//拆包
-		recMsg, err := dataPacker.Unpack(recdata)
+		//读取并拆包
+		recMsg, err := dataPacker.Decode(reader)
 		if err != nil {
-			fmt.Println("unpack error ", err)
+			fmt.Println("decode msg error ", err)
 			break
 		}
 
@@ -250,6 +202,8 @@ func clientRec(name string) {
 }
 
 func TestServerV0_3(t *testing.T) {
+	//加载测试客户端使用的配置(端口8091)
+	utils.SetConfigPath("../configs/tcp.toml")
 	//创建一个server句柄
 	s := NewServer()
 
@@ -310,3 +264,701 @@ func TestTimer(t *testing.T) {
 	var a string
 	fmt.Scan(&a)
 }
+
+//newTestServer 使用独立的默认配置创建一个监听在本地随机端口的Server
+func newTestServer() *Server {
+	s := NewServerWithConfig(utils.NewConfig()).(*Server)
+	s.IP = "127.0.0.1"
+	s.Port = 0
+	return s
+}
+
+//readTestMsg 按指定的封包格式从连接中读取一个完整的消息包
+func readTestMsg(conn net.Conn, dp iface.IDataPack) (iface.IMessage, error) {
+	return dp.Decode(conn)
+}
+
+//writeTestMsg 按指定的封包格式向连接写入一个消息包
+func writeTestMsg(conn net.Conn, dp iface.IDataPack, body string) error {
+	data, err := dp.Pack(NewMsgPackage([]byte(body)))
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(data)
+	return err
+}
+
+func TestServerStartBindError(t *testing.T) {
+	s1 := newTestServer()
+	if err := s1.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s1.Stop()
+
+	s2 := newTestServer()
+	s2.Port = s1.Addr().(*net.TCPAddr).Port
+	if err := s2.ListenAndServe(); err == nil || err == ErrServerClosed {
+		t.Fatalf("expected bind error, got %v", err)
+	}
+}
+
+func TestServerListenAndServeClosed(t *testing.T) {
+	s := newTestServer()
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- s.ListenAndServe()
+	}()
+
+	for s.Addr() == nil {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-errChan:
+		if err != ErrServerClosed {
+			t.Fatalf("expected ErrServerClosed, got %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("ListenAndServe did not return after Shutdown")
+	}
+
+	if err := s.Start(); err != ErrServerClosed {
+		t.Fatalf("expected ErrServerClosed on restart, got %v", err)
+	}
+}
+
+//slowRouter 延迟一段时间后才回复的路由
+type slowRouter struct {
+	BaseRouter
+	started chan struct{}
+}
+
+func (r *slowRouter) Handle(req iface.IRequest) error {
+	close(r.started)
+	time.Sleep(200 * time.Millisecond)
+	return req.GetConnection().SendBuffMsg([]byte(`{"status":0,"cmd":"response_slow"}`))
+}
+
+func TestServerShutdownDeadline(t *testing.T) {
+	s := newTestServer()
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	s.AddRouter("request_stuck", &funcRouter{handle: func(req iface.IRequest) error {
+		close(started)
+		<-release
+		return nil
+	}})
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := writeTestMsg(conn, s.GetDataPack(), `{"cmd":"request_stuck","seqno":"1"}`); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+
+	//处理方法一直不返回，Shutdown应在ctx超时时返回ctx的错误并强制关闭连接
+	begin := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+	if elapsed := time.Since(begin); elapsed < 200*time.Millisecond || elapsed > time.Second {
+		t.Fatalf("Shutdown returned after %s, expected near the 200ms deadline", elapsed)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, err := readTestMsg(conn, s.GetDataPack()); err != io.EOF {
+		t.Fatalf("expected EOF after shutdown deadline, got %v", err)
+	}
+}
+
+func TestServerShutdownPendingHandshake(t *testing.T) {
+	cert := newTestCert(t, "server", nil)
+	for name, opt := range map[string]Option{
+		"tls":   WithTLS(&tls.Config{Certificates: []tls.Certificate{cert.tlsCert(t)}}),
+		"proxy": WithProxyProtocol(),
+	} {
+		s := NewServer(WithAddr("127.0.0.1", 0), opt).(*Server)
+		if err := s.Start(); err != nil {
+			t.Fatal(err)
+		}
+		conn, err := net.Dial("tcp", s.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; s.ConnMgr.Len() != 1; i++ {
+			if i > 300 {
+				t.Fatalf("%s: conn not added", name)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		//连接仍在等待握手或PROXY头部，没有Writer，Shutdown不应等待其发送完缓冲消息
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		if err := s.Shutdown(ctx); err != nil {
+			t.Fatalf("%s: Shutdown returned %v", name, err)
+		}
+		cancel()
+		conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+		if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+			t.Fatalf("%s: expected EOF after shutdown, got %v", name, err)
+		}
+		conn.Close()
+	}
+}
+
+func TestServerShutdownUnderLoad(t *testing.T) {
+	s := newTestServer()
+	var handled, late int64
+	var closed int32
+	s.AddRouter("request_echo", &funcRouter{handle: func(req iface.IRequest) error {
+		atomic.AddInt64(&handled, 1)
+		if atomic.LoadInt32(&closed) == 1 {
+			atomic.AddInt64(&late, 1)
+		}
+		return req.GetConnection().SendMsg(req.GetMsg().GetBody())
+	}})
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	addr := s.Addr().String()
+
+	//客户端不断建立新连接并发送请求，Shutdown期间接入或读取到的请求都应在Shutdown返回前处理完
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				conn, err := net.Dial("tcp", addr)
+				if err != nil {
+					continue
+				}
+				for j := 0; j < 5; j++ {
+					writeTestMsg(conn, s.GetDataPack(), `{"cmd":"request_echo"}`)
+				}
+				conn.Close()
+			}
+		}()
+	}
+	for i := 0; atomic.LoadInt64(&handled) < 50; i++ {
+		if i > 300 {
+			t.Fatal("requests not handled")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := s.Shutdown(ctx)
+	atomic.StoreInt32(&closed, 1)
+	close(stop)
+	wg.Wait()
+	if err != nil {
+		t.Fatalf("Shutdown returned %v", err)
+	}
+	if n := s.ConnMgr.Len(); n != 0 {
+		t.Fatalf("%d conns left after Shutdown", n)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := atomic.LoadInt64(&late); n != 0 {
+		t.Fatalf("%d requests handled after Shutdown returned", n)
+	}
+}
+
+func TestServerStopStopsWorkers(t *testing.T) {
+	before := runtime.NumGoroutine()
+	for i := 0; i < 5; i++ {
+		s := newTestServer()
+		s.cfg.WorkerPoolSize = 10
+		if err := s.Start(); err != nil {
+			t.Fatal(err)
+		}
+		s.Stop()
+	}
+
+	//每次Start/Stop不应遗留worker
+	for i := 0; runtime.NumGoroutine() >= before+10; i++ {
+		if i > 300 {
+			t.Fatalf("goroutines leaked: before %d, after %d", before, runtime.NumGoroutine())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServerShutdownDrainsPendingReplies(t *testing.T) {
+	s := newTestServer()
+	router := &slowRouter{started: make(chan struct{})}
+	s.AddRouter("request_slow", router)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := writeTestMsg(conn, s.GetDataPack(), `{"cmd":"request_slow","seqno":"1"}`); err != nil {
+		t.Fatal(err)
+	}
+	<-router.started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	msg, err := readTestMsg(conn, s.GetDataPack())
+	if err != nil {
+		t.Fatalf("expected pending reply before close, got %v", err)
+	}
+	var ret dto.Result
+	if err := json.Unmarshal(msg.GetBody(), &ret); err != nil || ret.Cmd != "response_slow" {
+		t.Fatalf("unexpected reply %s", msg.GetBody())
+	}
+	if _, err := readTestMsg(conn, s.GetDataPack()); err != io.EOF {
+		t.Fatalf("expected EOF after shutdown, got %v", err)
+	}
+}
+
+//crcDataPack 测试用封包格式：2字节大端序包体长度 + 包体 + 1字节异或校验
+type crcDataPack struct{}
+
+func xorSum(data []byte) byte {
+	var sum byte
+	for _, b := range data {
+		sum ^= b
+	}
+	return sum
+}
+
+func (dp *crcDataPack) GetHeadLen() uint32 {
+	return 2
+}
+
+func (dp *crcDataPack) GetPkgLen(head []byte) (uint32, error) {
+	return dp.GetHeadLen() + uint32(binary.BigEndian.Uint16(head)) + 1, nil
+}
+
+func (dp *crcDataPack) Pack(msg iface.IMessage) ([]byte, error) {
+	body := msg.GetBody()
+	data := make([]byte, dp.GetHeadLen(), int(dp.GetHeadLen())+len(body)+1)
+	binary.BigEndian.PutUint16(data, uint16(len(body)))
+	data = append(data, body...)
+	return append(data, xorSum(body)), nil
+}
+
+func (dp *crcDataPack) Unpack(data []byte) (iface.IMessage, error) {
+	body := data[dp.GetHeadLen() : len(data)-1]
+	if xorSum(body) != data[len(data)-1] {
+		return nil, errors.New("crc mismatch")
+	}
+	return NewMsgPackage(body), nil
+}
+
+func (dp *crcDataPack) Decode(r io.Reader) (iface.IMessage, error) {
+	data, err := ReadPkg(r, dp)
+	if err != nil {
+		return nil, err
+	}
+	return dp.Unpack(data)
+}
+
+//echoRouter 原样返回请求内容的路由
+type echoRouter struct {
+	BaseRouter
+}
+
+func (r *echoRouter) Handle(req iface.IRequest) error {
+	return req.GetConnection().SendMsg(req.GetMsg().GetBody())
+}
+
+func TestServerCustomDataPack(t *testing.T) {
+	s := newTestServer()
+	s.SetDataPack(&crcDataPack{})
+	s.AddRouter("request_echo", &echoRouter{})
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+
+	req := `{"cmd":"request_echo","seqno":"42"}`
+	if err := writeTestMsg(conn, s.GetDataPack(), req); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := readTestMsg(conn, s.GetDataPack())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(msg.GetBody()) != req {
+		t.Fatalf("unexpected echo %s", msg.GetBody())
+	}
+
+	s.Broadcast([]byte("broadcast"))
+	msg, err = readTestMsg(conn, s.GetDataPack())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(msg.GetBody()) != "broadcast" {
+		t.Fatalf("unexpected broadcast %s", msg.GetBody())
+	}
+}
+
+func TestServerReadPartialAndCoalescedFrames(t *testing.T) {
+	s := newTestServer()
+	s.AddRouter("request_echo", &echoRouter{})
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	dp := s.GetDataPack()
+	first, _ := dp.Pack(NewMsgPackage([]byte(`{"cmd":"request_echo","seqno":"1"}`)))
+	second, _ := dp.Pack(NewMsgPackage([]byte(`{"cmd":"request_echo","seqno":"2"}`)))
+	third, _ := dp.Pack(NewMsgPackage([]byte(`{"cmd":"request_echo","seqno":"3"}`)))
+
+	//第一个包逐字节发送，模拟跨越多个TCP分段
+	for i := range first {
+		if _, err := conn.Write(first[i : i+1]); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	//后两个包粘连在一次写入中
+	if _, err := conn.Write(append(second, third...)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, seqno := range []string{"1", "2", "3"} {
+		msg, err := readTestMsg(conn, dp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ret dto.Result
+		if err := json.Unmarshal(msg.GetBody(), &ret); err != nil || ret.Seqno != seqno {
+			t.Fatalf("expected seqno %s, got %s", seqno, msg.GetBody())
+		}
+	}
+}
+
+func TestServerClosesConnOnPacketTooLarge(t *testing.T) {
+	s := newTestServer()
+	s.SetDataPack(&DataPack{MaxPacketSize: 16})
+	closeErrChan := make(chan error, 1)
+	s.SetOnConnStop(func(conn iface.IConnection) {
+		closeErrChan <- conn.GetCloseErr()
+	})
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+
+	//只发送声明了超大包体的包头，服务端不应等待或分配包体
+	head := make([]byte, NewDataPack().GetHeadLen())
+	binary.LittleEndian.PutUint32(head, 1<<30)
+	if _, err := conn.Write(head); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-closeErrChan:
+		if !errors.Is(err, ErrPacketTooLarge) {
+			t.Fatalf("expected ErrPacketTooLarge, got %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("connection was not closed")
+	}
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+}
+
+func TestServerEvictsIdleConn(t *testing.T) {
+	s := newTestServer()
+	s.ReadIdleTimeout = 300 * time.Millisecond
+	closeErrChan := make(chan error, 1)
+	s.SetOnConnStop(func(conn iface.IConnection) {
+		if code := conn.CloseReason().Code; code != iface.CloseIdleTimeout {
+			t.Errorf("expected CloseIdleTimeout, got %s", code)
+		}
+		closeErrChan <- conn.GetCloseErr()
+	})
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	select {
+	case err := <-closeErrChan:
+		if err != ErrIdleTimeout {
+			t.Fatalf("expected ErrIdleTimeout, got %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("idle connection was not evicted")
+	}
+}
+
+func TestServerSendsHeartbeat(t *testing.T) {
+	s := newTestServer()
+	s.HeartbeatInterval = 100 * time.Millisecond
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+
+	msg, err := readTestMsg(conn, s.GetDataPack())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ret dto.Result
+	if err := json.Unmarshal(msg.GetBody(), &ret); err != nil || ret.Cmd != HeartbeatCmd {
+		t.Fatalf("expected heartbeat, got %s", msg.GetBody())
+	}
+}
+
+func TestServerIndependentConfigs(t *testing.T) {
+	deviceCfg := utils.NewConfig()
+	deviceCfg.Host = "127.0.0.1"
+	deviceCfg.TcpPort = 0
+	deviceCfg.MaxConn = 1
+	device := NewServerWithConfig(deviceCfg)
+
+	adminCfg, err := utils.LoadConfig("../configs/tcp.toml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if adminCfg.TcpPort != 8091 || adminCfg.WorkerPoolSize != 5 || adminCfg.MaxConn != 100 {
+		t.Fatalf("unexpected loaded config %+v", adminCfg)
+	}
+	adminCfg.Host = "127.0.0.1"
+	adminCfg.TcpPort = 0
+	admin := NewServerWithConfig(adminCfg)
+
+	for _, s := range []iface.IServer{device, admin} {
+		if err := s.Start(); err != nil {
+			t.Fatal(err)
+		}
+		defer s.Stop()
+	}
+
+	//device服务只允许1个连接，第二个连接被关闭；admin服务不受影响
+	first, err := net.Dial("tcp", device.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	for device.GetConnMgr().Len() < 1 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	second, err := net.Dial("tcp", device.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	second.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, err := second.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected rejected conn EOF, got %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", admin.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+	}
+	for i := 0; admin.GetConnMgr().Len() < 2; i++ {
+		if i > 300 {
+			t.Fatalf("admin server accepted %d conns, want 2", admin.GetConnMgr().Len())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServerOptions(t *testing.T) {
+	before := *utils.GlobalObject
+	log := &logger.Logger{}
+	s := NewServer(
+		WithName("admin"),
+		WithAddr("127.0.0.1", 0),
+		WithIPVersion("tcp4"),
+		WithMaxConn(3),
+		WithWorkerPool(2, 8),
+		WithLogger(log),
+		WithDataPack(&crcDataPack{}),
+	).(*Server)
+
+	if s.Name != "admin" || s.IP != "127.0.0.1" || s.Port != 0 || s.IPVersion != "tcp4" {
+		t.Fatalf("unexpected server addr options %s %s:%d %s", s.Name, s.IP, s.Port, s.IPVersion)
+	}
+	if s.cfg.MaxConn != 3 || s.cfg.WorkerPoolSize != 2 || s.cfg.MaxWorkerTaskLen != 8 || s.GetLogger() != log {
+		t.Fatalf("unexpected server config %+v", s.cfg)
+	}
+	if !reflect.DeepEqual(*utils.GlobalObject, before) {
+		t.Fatal("options must not modify utils.GlobalObject")
+	}
+
+	s.AddRouter("request_echo", &echoRouter{})
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	client, _ := dialTestConn(t, s)
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(3 * time.Second))
+	req := `{"cmd":"request_echo"}`
+	if err := writeTestMsg(client, &crcDataPack{}, req); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := readTestMsg(client, &crcDataPack{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(msg.GetBody()) != req {
+		t.Fatalf("unexpected echo %s", msg.GetBody())
+	}
+}
+
+//skipWithoutIPv6 本机不支持IPv6回环地址时跳过测试
+func skipWithoutIPv6(t *testing.T) {
+	l, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skip("ipv6 loopback not available: ", err)
+	}
+	l.Close()
+}
+
+//echoOver 通过network连接addr并完成一次请求响应
+func echoOver(t *testing.T, s *Server, network, addr string) {
+	client, err := net.Dial(network, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(3 * time.Second))
+
+	req := `{"cmd":"request_echo"}`
+	if err := writeTestMsg(client, s.GetDataPack(), req); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := readTestMsg(client, s.GetDataPack())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(msg.GetBody()) != req {
+		t.Fatalf("unexpected reply %s", msg.GetBody())
+	}
+}
+
+func TestServerIPv6Loopback(t *testing.T) {
+	skipWithoutIPv6(t)
+
+	//配置中的IPv6地址带不带方括号均可
+	for _, host := range []string{"::1", "[::1]"} {
+		cfg := utils.NewConfig()
+		cfg.Host = host
+		cfg.TcpPort = 0
+		cfg.IPVersion = "tcp6"
+		s := NewServerWithConfig(cfg).(*Server)
+		s.AddRouter("request_echo", &echoRouter{})
+		if err := s.Start(); err != nil {
+			t.Fatal(err)
+		}
+
+		addr := s.Addr().(*net.TCPAddr)
+		if !addr.IP.Equal(net.IPv6loopback) {
+			s.Stop()
+			t.Fatalf("unexpected listen addr %s", addr)
+		}
+		echoOver(t, s, "tcp6", net.JoinHostPort("::1", strconv.Itoa(addr.Port)))
+		s.Stop()
+	}
+
+	//只监听IPv4时不能绑定IPv6地址
+	s := NewServer(WithAddr("::1", 0), WithIPVersion("tcp4"))
+	if err := s.Start(); err == nil {
+		s.Stop()
+		t.Fatal("tcp4 server should not bind an ipv6 address")
+	}
+}
+
+func TestServerDualStack(t *testing.T) {
+	skipWithoutIPv6(t)
+
+	s := NewServer(WithAddr("::", 0), WithIPVersion("tcp")).(*Server)
+	s.AddRouter("request_echo", &echoRouter{})
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	port := strconv.Itoa(s.Addr().(*net.TCPAddr).Port)
+	echoOver(t, s, "tcp6", net.JoinHostPort("::1", port))
+	echoOver(t, s, "tcp4", net.JoinHostPort("127.0.0.1", port))
+}
+
+func TestServerDefaultIPVersion(t *testing.T) {
+	cfg := utils.NewConfig()
+	cfg.IPVersion = ""
+	if s := NewServerWithConfig(cfg).(*Server); s.IPVersion != DefaultIPVersion {
+		t.Fatalf("unexpected default ip version %s", s.IPVersion)
+	}
+	if s := newTestServer(); s.IPVersion != "tcp4" {
+		t.Fatalf("default config should keep tcp4, got %s", s.IPVersion)
+	}
+}
@@ -0,0 +1,66 @@
+package impl
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	//TLSClientSubjectKey 连接属性：已校验的客户端证书Subject，如"CN=device-001,O=iot"
+	TLSClientSubjectKey = "tls_client_subject"
+	//TLSClientCommonNameKey 连接属性：已校验的客户端证书CommonName
+	TLSClientCommonNameKey = "tls_client_common_name"
+)
+
+//TLSHandshakeTimeout TLS握手的超时时间
+var TLSHandshakeTimeout = 10 * time.Second
+
+//loadTLSConfig 根据证书路径创建TLS配置，配置了客户端CA证书时要求并校验客户端证书(双向TLS)
+func loadTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}
+
+	if clientCAFile != "" {
+		caPem, err := ioutil.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPem) {
+			return nil, errors.New("no valid certificate found in " + clientCAFile)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+//handshake 完成TLS握手，客户端证书校验通过时将其Subject保存到连接属性中
+func (c *Connection) handshake(tlsConn *tls.Conn) error {
+	tlsConn.SetDeadline(time.Now().Add(TLSHandshakeTimeout))
+	if err := tlsConn.Handshake(); err != nil {
+		return err
+	}
+	//优雅关闭时保留stopReading设置的读超时
+	if atomic.LoadInt32(&c.draining) == 0 {
+		tlsConn.SetDeadline(time.Time{})
+	}
+
+	//只信任经过校验的证书链，未校验的客户端证书不写入属性
+	state := tlsConn.ConnectionState()
+	if len(state.VerifiedChains) > 0 && len(state.VerifiedChains[0]) > 0 {
+		cert := state.VerifiedChains[0][0]
+		c.SetProperty(TLSClientSubjectKey, cert.Subject.String())
+		c.SetProperty(TLSClientCommonNameKey, cert.Subject.CommonName)
+	}
+	return nil
+}
@@ -0,0 +1,264 @@
+package impl
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ajdwfnhaps/easy-tcp-server/iface"
+	"github.com/ajdwfnhaps/easy-tcp-server/utils"
+)
+
+//testCert 测试用证书及其PEM编码
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPem []byte
+	keyPem  []byte
+}
+
+func (c *testCert) tlsCert(t *testing.T) tls.Certificate {
+	pair, err := tls.X509KeyPair(c.certPem, c.keyPem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pair
+}
+
+//newTestCert 生成证书，parent为nil时生成自签名CA证书
+func newTestCert(t *testing.T, cn string, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn, Organization: []string{"iot"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPem:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}),
+	}
+}
+
+func certPool(certs ...*testCert) *x509.CertPool {
+	pool := x509.NewCertPool()
+	for _, c := range certs {
+		pool.AddCert(c.cert)
+	}
+	return pool
+}
+
+//echoTLS 通过TLS连接发送一条消息并读取回复
+func echoTLS(t *testing.T, s *Server, clientConfig *tls.Config) {
+	client, err := tls.Dial("tcp", s.Addr().String(), clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(3 * time.Second))
+
+	req := `{"cmd":"request_echo"}`
+	if err := writeTestMsg(client, s.GetDataPack(), req); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := readTestMsg(client, s.GetDataPack())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(msg.GetBody()) != req {
+		t.Fatalf("unexpected reply %s", msg.GetBody())
+	}
+}
+
+func TestTLSMutualAuth(t *testing.T) {
+	ca := newTestCert(t, "test-ca", nil)
+	serverCert := newTestCert(t, "server", ca)
+	clientCert := newTestCert(t, "device-001", ca)
+
+	s := NewServer(WithAddr("127.0.0.1", 0), WithTLS(&tls.Config{
+		Certificates: []tls.Certificate{serverCert.tlsCert(t)},
+		ClientCAs:    certPool(ca),
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})).(*Server)
+	s.AddRouter("request_echo", &echoRouter{})
+
+	subjects := make(chan interface{}, 1)
+	s.SetOnConnStart(func(conn iface.IConnection) {
+		subject, _ := conn.GetProperty(TLSClientSubjectKey)
+		subjects <- subject
+	})
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	echoTLS(t, s, &tls.Config{
+		RootCAs:      certPool(ca),
+		Certificates: []tls.Certificate{clientCert.tlsCert(t)},
+	})
+
+	select {
+	case subject := <-subjects:
+		if subject != "CN=device-001,O=iot" {
+			t.Fatalf("unexpected client subject %v", subject)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("OnConnStart not called")
+	}
+}
+
+func TestTLSRejectsPlainAndUntrustedClients(t *testing.T) {
+	ca := newTestCert(t, "test-ca", nil)
+	serverCert := newTestCert(t, "server", ca)
+	otherCA := newTestCert(t, "other-ca", nil)
+	untrusted := newTestCert(t, "device-002", otherCA)
+
+	s := NewServer(WithAddr("127.0.0.1", 0), WithTLS(&tls.Config{
+		Certificates: []tls.Certificate{serverCert.tlsCert(t)},
+		ClientCAs:    certPool(ca),
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})).(*Server)
+	s.AddRouter("request_echo", &echoRouter{})
+	started := make(chan struct{}, 2)
+	s.SetOnConnStart(func(conn iface.IConnection) {
+		started <- struct{}{}
+	})
+	stopped := make(chan struct{}, 4)
+	s.SetOnConnStop(func(conn iface.IConnection) {
+		stopped <- struct{}{}
+	})
+	s.SetOnConnClosed(func(conn iface.IConnection, reason iface.CloseReason) {
+		stopped <- struct{}{}
+	})
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	//明文客户端无法完成握手，连接被服务端关闭
+	plain, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	plain.SetDeadline(time.Now().Add(3 * time.Second))
+	if err := writeTestMsg(plain, s.GetDataPack(), `{"cmd":"request_echo"}`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readTestMsg(plain, s.GetDataPack()); err == nil {
+		t.Fatal("plain client should not get a reply")
+	}
+
+	//证书不受信任的客户端同样被拒绝
+	client, err := tls.Dial("tcp", s.Addr().String(), &tls.Config{
+		RootCAs:      certPool(ca),
+		Certificates: []tls.Certificate{untrusted.tlsCert(t)},
+	})
+	if err == nil {
+		defer client.Close()
+		client.SetDeadline(time.Now().Add(3 * time.Second))
+		writeTestMsg(client, s.GetDataPack(), `{"cmd":"request_echo"}`)
+		if _, err := readTestMsg(client, s.GetDataPack()); err == nil {
+			t.Fatal("untrusted client should not get a reply")
+		}
+	}
+
+	select {
+	case <-started:
+		t.Fatal("OnConnStart must not be called for failed handshakes")
+	case <-stopped:
+		t.Fatal("OnConnStop must not be called for conns that never started")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestTLSConfigFiles(t *testing.T) {
+	ca := newTestCert(t, "test-ca", nil)
+	serverCert := newTestCert(t, "server", ca)
+	clientCert := newTestCert(t, "device-003", ca)
+
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	write := func(name string, data []byte) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	cfg := utils.NewConfig()
+	cfg.Host = "127.0.0.1"
+	cfg.TcpPort = 0
+	cfg.TLSCertFile = write("server.pem", serverCert.certPem)
+	cfg.TLSKeyFile = write("server.key", serverCert.keyPem)
+	cfg.TLSClientCAFile = write("ca.pem", ca.certPem)
+
+	s := NewServerWithConfig(cfg).(*Server)
+	s.AddRouter("request_echo", &echoRouter{})
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	if s.TLSConfig == nil || s.TLSConfig.ClientAuth != tls.RequireAndVerifyClientCert {
+		t.Fatal("client CA file should enable mutual TLS")
+	}
+	echoTLS(t, s, &tls.Config{
+		RootCAs:      certPool(ca),
+		Certificates: []tls.Certificate{clientCert.tlsCert(t)},
+	})
+
+	//证书路径错误时Start返回错误
+	bad := utils.NewConfig()
+	bad.Host = "127.0.0.1"
+	bad.TcpPort = 0
+	bad.TLSCertFile = filepath.Join(dir, "missing.pem")
+	bad.TLSKeyFile = cfg.TLSKeyFile
+	if err := NewServerWithConfig(bad).Start(); err == nil {
+		t.Fatal("expected error for missing certificate file")
+	}
+}
@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"crypto/tls"
 	"os"
 
 	"github.com/BurntSushi/toml"
@@ -13,10 +14,15 @@ type GlobalObj struct {
 	/*
 		Server
 	*/
-	TcpServer iface.IServer //当前Zinx的全局Server对象
+	TcpServer iface.IServer //使用该配置的Server，ListenAndServe成功后设置；NewServer传入选项时使用配置的副本，不设置全局配置
 	Host      string        `toml:"host"`            //当前服务器主机IP
 	TcpPort   int           `toml:"port"`            //当前服务器主机监听端口号
 	Name      string        `toml:"tcp_server_name"` //当前服务器名称
+	IPVersion string        `toml:"ip_version"`      //监听的网络类型：tcp(IPv4及IPv6双栈)、tcp4(默认)或tcp6
+
+	Network        string `toml:"network"`          //监听的网络类型：tcp(默认)或unix
+	Address        string `toml:"address"`          //network为unix时监听的socket文件路径
+	UnixSocketMode string `toml:"unix_socket_mode"` //unix socket文件权限，八进制字符串如"0660"，为空时使用系统默认
 
 	/*
 		Zinx
@@ -24,10 +30,48 @@ type GlobalObj struct {
 	Version          string `toml:"version"`             //当前Zinx版本号
 	MaxPacketSize    uint32 `toml:"max_packet_size"`     //都需数据包的最大值
 	MaxConn          int    `toml:"max_conn"`            //当前服务器主机允许的最大链接个数
+	MaxConnPerIP     int    `toml:"max_conn_per_ip"`     //同一客户端IP允许的最大链接个数，0为不限制
 	WorkerPoolSize   uint32 `toml:"worker_pool_size"`    //业务工作Worker池的数量
 	MaxWorkerTaskLen uint32 `toml:"max_worker_task_len"` //业务工作Worker对应负责的任务队列最大任务存储数量
 	MaxMsgChanLen    uint32 `toml:"max_msg_chan_len"`    //SendBuffMsg发送消息的缓冲最大长度
 
+	SendOverflowPolicy string `toml:"send_overflow_policy"` //发送队列已满时的处理策略：block(默认)、drop_newest、drop_oldest、disconnect
+	SendTimeoutMs      int    `toml:"send_timeout_ms"`      //发送队列已满时最长等待时间(毫秒)，block策略下0为一直等待，其他策略下0为不等待
+
+	HandlerTimeoutMs int            `toml:"handler_timeout_ms"` //处理请求的默认超时时间(毫秒)，超时后回复错误响应并释放worker，0为不限制
+	RouteTimeoutsMs  map[string]int `toml:"route_timeouts_ms"`  //各cmd的超时时间(毫秒)，优先于handler_timeout_ms，小于0为不限制
+
+	ReadIdleTimeout   int `toml:"read_idle_timeout"`  //读空闲超时(秒)，超过该时长未收到客户端数据则关闭连接，0为不检测
+	WriteTimeout      int `toml:"write_timeout"`      //写超时(秒)，0为不限制
+	HeartbeatInterval int `toml:"heartbeat_interval"` //服务端心跳间隔(秒)，连接空闲超过该时长时向客户端发送心跳，0为不发送
+
+	TCPKeepAlive   int `toml:"tcp_keepalive"`    //TCP keepalive探测间隔(秒)，0为系统默认
+	TCPReadBuffer  int `toml:"tcp_read_buffer"`  //TCP系统读缓冲区大小(字节)，0为系统默认
+	TCPWriteBuffer int `toml:"tcp_write_buffer"` //TCP系统写缓冲区大小(字节)，0为系统默认
+
+	AcceptRate       float64 `toml:"accept_rate"`         //每秒允许接入的连接数，0为不限制
+	AcceptBurst      int     `toml:"accept_burst"`        //瞬间允许接入的连接数，0时取accept_rate
+	AcceptRatePerIP  float64 `toml:"accept_rate_per_ip"`  //同一客户端IP每秒允许接入的连接数，0为不限制
+	AcceptBurstPerIP int     `toml:"accept_burst_per_ip"` //同一客户端IP瞬间允许接入的连接数，0时取accept_rate_per_ip
+
+	/*
+		TLS
+	*/
+	TLSCertFile     string `toml:"tls_cert_file"`      //服务端证书路径，配置后启用TLS
+	TLSKeyFile      string `toml:"tls_key_file"`       //服务端私钥路径
+	TLSClientCAFile string `toml:"tls_client_ca_file"` //客户端CA证书路径，配置后要求并校验客户端证书(双向TLS)
+
+	/*
+		PROXY protocol
+	*/
+	ProxyProtocol  bool     `toml:"proxy_protocol"`  //是否解析负载均衡发送的PROXY协议(v1、v2)头部
+	TrustedProxies []string `toml:"trusted_proxies"` //受信任代理的CIDR列表，只解析来自这些地址的头部，为空时信任所有对端
+
+	/*
+		Listeners
+	*/
+	Listeners []ListenerConfig `toml:"listeners"` //除host、port外额外监听的地址
+
 	/*
 		config file path
 	*/
@@ -37,12 +81,27 @@ type GlobalObj struct {
 	Logger logger.ILogger
 }
 
+//ListenerConfig 额外监听地址的配置，同一Server的所有监听器共享路由、连接管理及广播
+type ListenerConfig struct {
+	Name            string `toml:"name"`               //监听器名称，为空时使用address
+	Network         string `toml:"network"`            //网络类型：tcp(默认)、tcp4、tcp6或unix
+	Address         string `toml:"address"`            //监听地址，tcp时为host:port，unix时为socket文件路径
+	MaxConn         int    `toml:"max_conn"`           //该监听器允许的最大连接个数，0为只受全局max_conn限制
+	TLSCertFile     string `toml:"tls_cert_file"`      //服务端证书路径，配置后该监听器启用TLS
+	TLSKeyFile      string `toml:"tls_key_file"`       //服务端私钥路径
+	TLSClientCAFile string `toml:"tls_client_ca_file"` //客户端CA证书路径，配置后要求并校验客户端证书
+	UnixSocketMode  string `toml:"unix_socket_mode"`   //unix socket文件权限，八进制字符串如"0660"
+	ProxyProtocol   bool   `toml:"proxy_protocol"`     //是否解析PROXY协议头部，受信任代理使用全局trusted_proxies
+
+	TLSConfig *tls.Config `toml:"-"` //TLS配置，优先于证书路径
+}
+
 //TCPConfig 统一配置类
 type TCPConfig struct {
 	Opt *GlobalObj `toml:"tcp"`
 }
 
-//GlobalObject 定义一个全局的对象
+//GlobalObject 定义一个全局的对象，作为impl.NewServer()的默认配置，保持向后兼容
 var GlobalObject *GlobalObj
 
 //PathExists 判断一个文件是否存在
@@ -72,16 +131,14 @@ func Reload(c *TCPConfig) {
 
 }
 
-/*
-	提供init方法，默认加载
-*/
-func init() {
-	//初始化GlobalObject变量，设置一些默认值
-	GlobalObject = &GlobalObj{
+//NewConfig 创建一份使用默认值的配置，每个Server可持有各自独立的配置
+func NewConfig() *GlobalObj {
+	return &GlobalObj{
 		Name:             "AamIotTcpServer",
 		Version:          "V1.0.0",
 		TcpPort:          8090,
 		Host:             "0.0.0.0",
+		IPVersion:        "tcp4",
 		MaxConn:          12000,
 		MaxPacketSize:    4096,
 		ConfFilePath:     "../configs/tcp.toml",
@@ -89,9 +146,24 @@ func init() {
 		MaxWorkerTaskLen: 1024,
 		MaxMsgChanLen:    1024,
 	}
+}
 
-	//从配置文件中加载一些用户配置的参数
-	Reload(&TCPConfig{Opt: GlobalObject})
+//LoadConfig 在默认配置的基础上读取fpath配置文件，返回一份独立的配置
+func LoadConfig(fpath string) (*GlobalObj, error) {
+	g := NewConfig()
+	g.ConfFilePath = fpath
+	if _, err := toml.DecodeFile(fpath, &TCPConfig{Opt: g}); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+/*
+	提供init方法，初始化默认配置，配置文件需通过SetConfigPath加载
+*/
+func init() {
+	//初始化GlobalObject变量，设置一些默认值
+	GlobalObject = NewConfig()
 }
 
 //SetConfigPath 设置配置文件路径